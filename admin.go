@@ -0,0 +1,239 @@
+package moresql
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxHeldOps is the most ops a paused fan holds, its
+// broker then stops reading the fan until it is resumed
+const maxHeldOps = 100000
+
+// fanGate pauses the delivery of a fan's ops to its workers. Ops read
+// while paused are held in order, and stay tracked so the checkpoint
+// can't move past them until the fan is resumed.
+type fanGate struct {
+	mu      sync.Mutex
+	paused  bool
+	held    []Op
+	limit   int
+	resumed chan struct{}
+}
+
+func newFanGate(limit int) *fanGate {
+	return &fanGate{limit: limit, resumed: make(chan struct{}, 1)}
+}
+
+// hold keeps op when the fan is paused, or while ops held
+// before a resume are still waiting to be released
+func (g *fanGate) hold(op Op) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paused && len(g.held) == 0 {
+		return false
+	}
+	g.held = append(g.held, op)
+	return true
+}
+
+// release hands back the held ops once the fan is resumed
+func (g *fanGate) release() []Op {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		return nil
+	}
+	held := g.held
+	g.held = nil
+	return held
+}
+
+func (g *fanGate) Pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paused = true
+}
+
+func (g *fanGate) Resume() {
+	g.mu.Lock()
+	g.paused = false
+	g.mu.Unlock()
+	select {
+	case g.resumed <- struct{}{}:
+	default:
+	}
+}
+
+// retire resumes the fan for good, handing back the held ops
+func (g *fanGate) retire() []Op {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	held := g.held
+	g.held, g.paused = nil, false
+	return held
+}
+
+// full reports whether the paused fan holds its limit of ops
+func (g *fanGate) full() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused && len(g.held) >= g.limit
+}
+
+func (g *fanGate) state() (paused bool, held int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.paused, len(g.held)
+}
+
+type fanStatus struct {
+	Key      string           `json:"key"`
+	Paused   bool             `json:"paused"`
+	Depth    int              `json:"depth"`
+	Held     int              `json:"held"`
+	Counters map[string]int64 `json:"counters"`
+}
+
+type checkpointStatus struct {
+	Latest       interface{}            `json:"latest"`
+	ResumeTokens map[string]interface{} `json:"resume_tokens"`
+	Saved        *checkpointSave        `json:"saved,omitempty"`
+}
+
+// HandleAdmin adds the admin API to the mux served by -enable-monitor:
+//
+//	GET  /admin/fans                    fan keys with depth, counters and state
+//	POST /admin/fans/pause?key=k        hold the ops of fan key k
+//	POST /admin/fans/resume?key=k       release and resume fan key k
+//	GET  /admin/checkpoint              the checkpoint in memory
+//	POST /admin/checkpoint              save the checkpoint now
+//	POST /admin/config/reload           reload -config-file
+func HandleAdmin(mux *http.ServeMux, env Env) {
+	mux.HandleFunc("/admin/fans", adminHandler(http.MethodGet, func(t *Tailer, r *http.Request) (interface{}, error) {
+		return t.fanStatuses(), nil
+	}))
+	mux.HandleFunc("/admin/fans/pause", adminHandler(http.MethodPost, func(t *Tailer, r *http.Request) (interface{}, error) {
+		return t.setPaused(r.URL.Query().Get("key"), true)
+	}))
+	mux.HandleFunc("/admin/fans/resume", adminHandler(http.MethodPost, func(t *Tailer, r *http.Request) (interface{}, error) {
+		return t.setPaused(r.URL.Query().Get("key"), false)
+	}))
+	mux.HandleFunc("/admin/checkpoint", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			adminHandler(http.MethodGet, func(t *Tailer, r *http.Request) (interface{}, error) {
+				return t.checkpointStatus(), nil
+			})(w, r)
+		default:
+			adminHandler(http.MethodPost, func(t *Tailer, r *http.Request) (interface{}, error) {
+				if err := t.SaveLatestCheckpoint(); err != nil {
+					return nil, err
+				}
+				return t.checkpointStatus(), nil
+			})(w, r)
+		}
+	})
+	mux.HandleFunc("/admin/config/reload", adminHandler(http.MethodPost, func(t *Tailer, r *http.Request) (interface{}, error) {
+		diff, err := t.ReloadConfigFile(env.configFile)
+		if err != nil {
+			return nil, adminError{http.StatusUnprocessableEntity, err}
+		}
+		return diff, nil
+	}))
+}
+
+type adminError struct {
+	status int
+	err    error
+}
+
+func (e adminError) Error() string { return e.err.Error() }
+
+func adminHandler(method string, fn func(t *Tailer, r *http.Request) (interface{}, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		reply := func(status int, body interface{}) {
+			w.WriteHeader(status)
+			if err := json.NewEncoder(w).Encode(body); err != nil {
+				log.WithField("error", err).Error("Unable to write admin reply")
+			}
+		}
+		if r.Method != method {
+			reply(http.StatusMethodNotAllowed, map[string]string{"error": method + " only"})
+			return
+		}
+		t, ok := healthTailer.Load().(*Tailer)
+		if !ok {
+			reply(http.StatusServiceUnavailable, map[string]string{"error": "not tailing"})
+			return
+		}
+		body, err := fn(t, r)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if e, ok := err.(adminError); ok {
+				status = e.status
+			}
+			reply(status, map[string]string{"error": err.Error()})
+			return
+		}
+		reply(http.StatusOK, body)
+	}
+}
+
+func (t *Tailer) fanStatuses() []fanStatus {
+	statuses := []fanStatus{}
+	fan, gates := t.fans()
+	for key, c := range fan {
+		status := fanStatus{Key: key, Depth: len(c), Counters: make(map[string]int64)}
+		if gate := gates[key]; gate != nil {
+			status.Paused, status.Held = gate.state()
+		}
+		db, collection, export := splitFanKey(key)
+		for name, counter := range map[string]counterVec{
+			"read":    readTotal,
+			"insert":  insertTotal,
+			"update":  updateTotal,
+			"delete":  deleteTotal,
+			"skipped": skippedTotal,
+			"errors":  errorsTotal,
+		} {
+			status.Counters[name] = int64(counter.Value(db, collection, export))
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Key < statuses[j].Key })
+	return statuses
+}
+
+func (t *Tailer) setPaused(key string, paused bool) (interface{}, error) {
+	_, gates := t.fans()
+	gate, ok := gates[key]
+	if !ok {
+		return nil, adminError{http.StatusNotFound, fmt.Errorf("unknown fan key %q, expected db.collection.export", key)}
+	}
+	if paused {
+		gate.Pause()
+	} else {
+		gate.Resume()
+	}
+	_, held := gate.state()
+	log.WithFields(log.Fields{"key": key, "paused": paused, "held": held}).Warn("Fan paused state changed from the admin API")
+	return map[string]interface{}{"key": key, "paused": paused, "held": held}, nil
+}
+
+func (t *Tailer) checkpointStatus() checkpointStatus {
+	status := checkpointStatus{ResumeTokens: t.resumeTokens()}
+	if latest, ok := t.checkpoint.Get("latest"); ok {
+		status.Latest = latest
+	}
+	if v, ok := t.checkpoint.Get("saved"); ok {
+		saved := v.(checkpointSave)
+		status.Saved = &saved
+	}
+	return status
+}
@@ -0,0 +1,68 @@
+package moresql_test
+
+import (
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+)
+
+func opIDs(ops []m.Op) []interface{} {
+	ids := []interface{}{}
+	for _, op := range ops {
+		ids = append(ids, op.ID())
+	}
+	return ids
+}
+
+func (s *MySuite) TestFanGateHoldRelease(c *C) {
+	g := m.NewFanGate(10)
+	c.Check(g.Hold(m.NewOp(1)), Equals, false)
+
+	g.Pause()
+	c.Check(g.Hold(m.NewOp(2)), Equals, true)
+	c.Check(g.Hold(m.NewOp(3)), Equals, true)
+	paused, held := g.State()
+	c.Check(paused, Equals, true)
+	c.Check(held, Equals, 2)
+	c.Check(g.Release(), HasLen, 0)
+
+	g.Resume()
+	// Ops held before the resume go first
+	c.Check(g.Hold(m.NewOp(4)), Equals, true)
+	c.Check(opIDs(g.Release()), DeepEquals, []interface{}{2, 3, 4})
+	c.Check(g.Hold(m.NewOp(5)), Equals, false)
+	paused, held = g.State()
+	c.Check(paused, Equals, false)
+	c.Check(held, Equals, 0)
+}
+
+func (s *MySuite) TestFanGateRetire(c *C) {
+	g := m.NewFanGate(10)
+	g.Pause()
+	g.Hold(m.NewOp(1))
+	g.Hold(m.NewOp(2))
+	c.Check(opIDs(g.Retire()), DeepEquals, []interface{}{1, 2})
+	paused, held := g.State()
+	c.Check(paused, Equals, false)
+	c.Check(held, Equals, 0)
+	c.Check(g.Hold(m.NewOp(3)), Equals, false)
+}
+
+func (s *MySuite) TestFanGateFull(c *C) {
+	g := m.NewFanGate(2)
+	g.Pause()
+	g.Hold(m.NewOp(1))
+	c.Check(g.Full(), Equals, false)
+	g.Hold(m.NewOp(2))
+	c.Check(g.Full(), Equals, true)
+	g.Resume()
+	c.Check(g.Full(), Equals, false)
+}
+
+func (s *MySuite) TestSplitFanKey(c *C) {
+	db, collection, export := m.SplitFanKey("db.users.postgres")
+	c.Check([]string{db, collection, export}, DeepEquals, []string{"db", "users", "postgres"})
+	db, collection, export = m.SplitFanKey("db.users.archive.mongo")
+	c.Check([]string{db, collection, export}, DeepEquals, []string{"db", "users.archive", "mongo"})
+	db, collection, export = m.SplitFanKey("db")
+	c.Check([]string{db, collection, export}, DeepEquals, []string{"db", "", ""})
+}
@@ -0,0 +1,247 @@
+package moresql
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rwynn/gtm"
+	log "github.com/sirupsen/logrus"
+)
+
+// pgRow is the latest pending write for a single _id
+type pgRow struct {
+	op     *gtm.Op
+	delete bool
+	data   map[string]interface{}
+}
+
+// pgBatch holds the pending writes of a single table.
+// Only the last write per _id is kept so a flush applies
+// the same end state as executing every op in order.
+type pgBatch struct {
+	mu         sync.Mutex
+	coll       Collection
+	justInsert bool
+	ids        map[string]int
+	rows       []pgRow
+}
+
+// pgBatcher groups postgres writes per table and sends them
+// as multi row statements once a table reaches size rows
+// or when Flush is called by the Tailer's flush timer.
+type pgBatcher struct {
+	pg         *sqlx.DB
+	size       int
+	justInsert bool
+	mu         sync.Mutex
+	tables     map[string]*pgBatch
+	// deadLetters keeps the rows of a failed flush when set
+	deadLetters DeadLetterStore
+	appName     string
+	retry       RetryPolicy
+	ctx         context.Context
+	// skipError drops the rows of a failed flush, logging each _id,
+	// instead of keeping them for the next flush
+	skipError bool
+}
+
+func newPgBatcher(ctx context.Context, pg *sqlx.DB, size int, justInsert bool, retry RetryPolicy) *pgBatcher {
+	return &pgBatcher{ctx: ctx, pg: pg, size: size, justInsert: justInsert, retry: retry, tables: make(map[string]*pgBatch)}
+}
+
+func (b *pgBatcher) table(coll Collection) *pgBatch {
+	key := coll.pgTableQuoted()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	batch, ok := b.tables[key]
+	if !ok {
+		batch = &pgBatch{coll: coll, justInsert: b.justInsert, ids: make(map[string]int)}
+		b.tables[key] = batch
+	}
+	return batch
+}
+
+// Upsert queues data to be inserted or updated
+func (b *pgBatcher) Upsert(op *gtm.Op, coll Collection, data map[string]interface{}) error {
+	return b.add(coll, pgRow{op: op, data: data})
+}
+
+// Delete queues data's _id to be deleted
+func (b *pgBatcher) Delete(op *gtm.Op, coll Collection, data map[string]interface{}) error {
+	return b.add(coll, pgRow{op: op, delete: true, data: data})
+}
+
+func (b *pgBatcher) add(coll Collection, row pgRow) error {
+	batch := b.table(coll)
+	batch.mu.Lock()
+	defer batch.mu.Unlock()
+	batch.add(row)
+	if len(batch.rows) < b.size {
+		return nil
+	}
+	// row is queued either way. A failed flush keeps the rows of the
+	// whole batch, so it is reported by the next Flush, not against row.
+	if err := b.flush(batch); err != nil {
+		log.WithFields(log.Fields{"error": err}).Warn("Unable to flush full batch, keeping its rows")
+	}
+	return nil
+}
+
+// Flush writes the pending rows of every table
+func (b *pgBatcher) Flush() error {
+	b.mu.Lock()
+	batches := []*pgBatch{}
+	for _, batch := range b.tables {
+		batches = append(batches, batch)
+	}
+	b.mu.Unlock()
+
+	var firstErr error
+	for _, batch := range batches {
+		batch.mu.Lock()
+		err := b.flush(batch)
+		batch.mu.Unlock()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// flush must be called while holding batch.mu. The rows of a batch
+// that still fails after retrying are saved as dead letters, dropped
+// with -skip-error, or else kept so the checkpoint saved after a
+// Flush never gets past them.
+func (b *pgBatcher) flush(batch *pgBatch) error {
+	if len(batch.rows) == 0 {
+		return nil
+	}
+	rows := batch.rows
+	err := b.retry.Do(b.ctx, func() error { return batch.apply(b.pg) })
+	if err == nil {
+		batch.reset()
+		return nil
+	}
+	table := batch.coll.pgTableQuoted()
+	if b.deadLetters != nil && b.saveDeadLetters(rows, err) {
+		batch.reset()
+		log.WithFields(log.Fields{
+			"table": table,
+			"rows":  len(rows),
+			"error": err,
+		}).Warn("Saved failed batch as dead letters")
+		return nil
+	}
+	if !b.skipError {
+		return fmt.Errorf("flushing %d rows into %s: %s", len(rows), table, err)
+	}
+	for _, row := range rows {
+		fields := log.Fields{"table": table, "id": row.data["_id"], "error": err}
+		if row.op != nil {
+			fields["namespace"] = row.op.Namespace
+		}
+		log.WithFields(fields).Error("Dropped batched row")
+	}
+	batch.reset()
+	return nil
+}
+
+// saveDeadLetters stores every row of a failed flush,
+// it reports false unless all of them were saved
+func (b *pgBatcher) saveDeadLetters(rows []pgRow, err error) bool {
+	for _, row := range rows {
+		if row.op == nil {
+			return false
+		}
+		d, dErr := NewDeadLetter(b.appName, row.op, postgresExport, row.data, err)
+		if dErr == nil {
+			dErr = b.deadLetters.Put(d)
+		}
+		if dErr != nil {
+			log.WithFields(log.Fields{"error": dErr, "namespace": row.op.Namespace, "id": row.op.Id}).Error("Unable to save dead letter")
+			return false
+		}
+	}
+	return true
+}
+
+func (p *pgBatch) add(row pgRow) {
+	if p.justInsert {
+		p.rows = append(p.rows, row)
+		return
+	}
+	id := fmt.Sprintf("%v", row.data["_id"])
+	if i, ok := p.ids[id]; ok {
+		// Last write wins, keep the position of the earlier write
+		p.rows[i] = row
+		return
+	}
+	p.ids[id] = len(p.rows)
+	p.rows = append(p.rows, row)
+}
+
+func (p *pgBatch) reset() {
+	p.ids = make(map[string]int)
+	p.rows = nil
+}
+
+// apply writes the rows in a single transaction, it must be called
+// while holding p.mu so batches of a table are never applied out of order
+func (p *pgBatch) apply(pg *sqlx.DB) error {
+	o := Statement{p.coll}
+	deletes := []interface{}{}
+	upserts := [][]interface{}{}
+	for _, row := range p.rows {
+		if row.delete {
+			deletes = append(deletes, row.data["_id"])
+		} else {
+			upserts = append(upserts, o.BulkValues(row.data))
+		}
+	}
+
+	tx, err := pg.Beginx()
+	if err != nil {
+		return err
+	}
+	limit := o.BulkRowLimit()
+	for len(deletes) > 0 {
+		n := len(deletes)
+		if n > maxBulkParams {
+			n = maxBulkParams
+		}
+		if _, err := tx.Exec(o.BuildBulkDelete(n), deletes[:n]...); err != nil {
+			tx.Rollback()
+			return err
+		}
+		deletes = deletes[n:]
+	}
+	for len(upserts) > 0 {
+		n := len(upserts)
+		if n > limit {
+			n = limit
+		}
+		query := o.BuildBulkUpsert(n)
+		if p.justInsert {
+			query = o.BuildBulkInsert(n)
+		}
+		args := []interface{}{}
+		for _, values := range upserts[:n] {
+			args = append(args, values...)
+		}
+		if _, err := tx.Exec(query, args...); err != nil {
+			tx.Rollback()
+			return err
+		}
+		upserts = upserts[n:]
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"table": o.Collection.pgTableQuoted(),
+		"rows":  len(p.rows),
+	}).Debug("Flushed batch")
+	return nil
+}
@@ -0,0 +1,76 @@
+package moresql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rwynn/gtm"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ClusterTimestamp is the current position of the tail: the last oplog
+// entry when tailing the oplog, the cluster's operation time otherwise
+func ClusterTimestamp(ctx context.Context, client *mongo.Client, tailType string) (primitive.Timestamp, error) {
+	if tailType == optLog {
+		return gtm.LastOpTimestamp(client, gtm.DefaultOptions())
+	}
+	var result struct {
+		OperationTime primitive.Timestamp `bson:"operationTime"`
+	}
+	err := client.Database("admin").RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&result)
+	if err != nil {
+		return primitive.Timestamp{}, err
+	}
+	if result.OperationTime.T == 0 {
+		return primitive.Timestamp{}, fmt.Errorf("mongo did not return an operationTime, is it a replica set?")
+	}
+	return result.OperationTime, nil
+}
+
+// Bootstrap records the cluster time, full syncs every collection and then
+// tails from the recorded time. Writes made during the full sync are
+// replayed by the tail, which is harmless as every write is an upsert.
+// The progress of a previous full sync is dropped, as documents it read
+// before the recorded time could have changed since.
+func Bootstrap(ctx context.Context, o Options) error {
+	env := o.Env
+	if o.Postgres != nil {
+		ClearFullSyncProgress(o.Postgres, env.appName)
+	}
+	start, err := ClusterTimestamp(ctx, o.Mongo, env.tailType)
+	if err != nil {
+		return fmt.Errorf("reading the cluster time: %s", err)
+	}
+	log.WithFields(log.Fields{"app_name": env.appName}).Infof("Bootstrapping, tail will start from timestamp: %d.%d", start.T, start.I)
+
+	if err := FullSync(ctx, o); err != nil {
+		return err
+	}
+
+	// The tail only starts from a timestamp in the past,
+	// a shorter full sync would start from now instead
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Until(time.Unix(int64(start.T)+1, 0))):
+	}
+
+	env.replaySecond = 0
+	o.Env = env
+	service, err := NewTailer(o)
+	if err != nil {
+		return err
+	}
+	m := MoresqlMetadata{AppName: env.appName, LastEpoch: int64(start.T), LastOrdinal: int64(start.I), ResumeTokens: "{}", ProcessedAt: time.Now()}
+	for db := range o.Config {
+		if err := service.SaveCheckpoint(m, db); err != nil {
+			return fmt.Errorf("saving the bootstrap checkpoint: %s", err)
+		}
+	}
+	log.WithFields(log.Fields{"app_name": env.appName}).Infof("Full sync done, tailing from timestamp: %d.%d", start.T, start.I)
+	return serve(ctx, service, env)
+}
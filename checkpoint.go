@@ -0,0 +1,166 @@
+package moresql
+
+import (
+	"container/list"
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// resumeTokenPrefix namespaces the change stream resume tokens
+// kept in the Tailer's checkpoint map, one per stream
+const resumeTokenPrefix = "token."
+
+func resumeTokenKey(ns string) string {
+	return resumeTokenPrefix + ns
+}
+
+// Timestamp rebuilds the exact oplog position of the checkpoint.
+// Checkpoints written before last_ordinal existed have an ordinal of 0
+// so the whole second is replayed rather than skipped.
+func (m MoresqlMetadata) Timestamp() primitive.Timestamp {
+	return primitive.Timestamp{T: uint32(m.LastEpoch), I: uint32(m.LastOrdinal)}
+}
+
+// DecodeResumeTokens returns the change stream resume tokens
+// stored in the checkpoint keyed by namespace
+func (m MoresqlMetadata) DecodeResumeTokens() (map[string]interface{}, error) {
+	tokens := make(map[string]interface{})
+	if len(m.ResumeTokens) == 0 {
+		return tokens, nil
+	}
+	encoded := make(map[string]string)
+	if err := json.Unmarshal([]byte(m.ResumeTokens), &encoded); err != nil {
+		return nil, err
+	}
+	for ns, s := range encoded {
+		var token primitive.D
+		if err := bson.UnmarshalExtJSON([]byte(s), true, &token); err != nil {
+			return nil, err
+		}
+		tokens[ns] = token
+	}
+	return tokens, nil
+}
+
+// EncodeResumeTokens stores tokens as a json object of
+// namespace to canonical extended json resume token
+func EncodeResumeTokens(tokens map[string]interface{}) (string, error) {
+	encoded := make(map[string]string)
+	for ns, token := range tokens {
+		b, err := bson.MarshalExtJSON(token, true, false)
+		if err != nil {
+			return "", err
+		}
+		encoded[ns] = string(b)
+	}
+	b, err := json.Marshal(encoded)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// resumeTokens collects the latest resume token of each change stream
+func (t *Tailer) resumeTokens() map[string]interface{} {
+	tokens := make(map[string]interface{})
+	for item := range t.checkpoint.IterBuffered() {
+		if strings.HasPrefix(item.Key, resumeTokenPrefix) {
+			tokens[strings.TrimPrefix(item.Key, resumeTokenPrefix)] = item.Val
+		}
+	}
+	return tokens
+}
+
+// maxTrackedOps is the most ops waiting to move the checkpoint,
+// Read then waits until the oldest of them is written
+const maxTrackedOps = 1000000
+
+// TrackedOp is an op that Read handed to the exports and
+// that is waiting for each of them to acknowledge it.
+// Only the fields of the op the checkpoint needs are kept.
+type TrackedOp struct {
+	op        *gtm.Op
+	remaining int
+}
+
+// CheckpointTracker records in-flight ops in the order Read received
+// them, across dedicated and overflow workers. Once every op up to and
+// including an op has been acknowledged by all of its exports, those ops
+// are handed to onSafe in order and the last becomes the low watermark.
+// A fast worker can therefore never move the checkpoint past an op a
+// slow one still holds.
+type CheckpointTracker struct {
+	mu      sync.Mutex
+	pending *list.List
+	onSafe  func(op *gtm.Op)
+	// limit is the most pending ops before Full, none when 0
+	limit int
+	// freed is signaled whenever pending ops become safe
+	freed chan struct{}
+}
+
+func NewCheckpointTracker(onSafe func(op *gtm.Op)) *CheckpointTracker {
+	return &CheckpointTracker{pending: list.New(), onSafe: onSafe, freed: make(chan struct{}, 1)}
+}
+
+// Track registers op as sent to the given number of exports,
+// it must be called before op is handed to any worker
+func (c *CheckpointTracker) Track(op *gtm.Op, exports int) *TrackedOp {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The document isn't kept, ops pile up here while a fan is paused
+	position := &gtm.Op{Namespace: op.Namespace, Timestamp: op.Timestamp, ResumeToken: op.ResumeToken}
+	tracked := &TrackedOp{op: position, remaining: exports}
+	c.pending.PushBack(tracked)
+	c.advance()
+	return tracked
+}
+
+// Ack records that one export has committed the op
+func (c *CheckpointTracker) Ack(tracked *TrackedOp) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	tracked.remaining--
+	c.advance()
+}
+
+// InFlight is the number of ops not yet below the watermark
+func (c *CheckpointTracker) InFlight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pending.Len()
+}
+
+// Full reports whether limit ops are pending
+func (c *CheckpointTracker) Full() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.limit > 0 && c.pending.Len() >= c.limit
+}
+
+// Freed is signaled when pending ops become safe after Full
+func (c *CheckpointTracker) Freed() <-chan struct{} {
+	return c.freed
+}
+
+func (c *CheckpointTracker) advance() {
+	for e := c.pending.Front(); e != nil; e = c.pending.Front() {
+		tracked := e.Value.(*TrackedOp)
+		if tracked.remaining > 0 {
+			return
+		}
+		c.pending.Remove(e)
+		if c.onSafe != nil {
+			c.onSafe(tracked.op)
+		}
+		select {
+		case c.freed <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package moresql_test
+
+import (
+	"time"
+
+	"github.com/rwynn/gtm"
+	m "github.com/zph/moresql"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestMetadataTimestamp(c *C) {
+	metadata := m.MoresqlMetadata{LastEpoch: 1485144398, LastOrdinal: 7}
+	c.Check(metadata.Timestamp(), Equals, primitive.Timestamp{T: 1485144398, I: 7})
+
+	after, err := m.BuildOptionAfterFromMongoTimestamp(metadata.Timestamp(), time.Duration(0))
+	c.Check(err, IsNil)
+	actual, _ := after(nil, nil)
+	c.Check(actual, Equals, primitive.Timestamp{T: 1485144398, I: 7})
+}
+
+func (s *MySuite) TestResumeTokensRoundTrip(c *C) {
+	tokens := map[string]interface{}{
+		"db.users":  primitive.D{{Key: "_data", Value: "825F1A"}},
+		"db.orders": primitive.D{{Key: "_data", Value: "825F1B"}},
+	}
+	encoded, err := m.EncodeResumeTokens(tokens)
+	c.Check(err, IsNil)
+
+	metadata := m.MoresqlMetadata{ResumeTokens: encoded}
+	decoded, err := metadata.DecodeResumeTokens()
+	c.Check(err, IsNil)
+	c.Check(decoded, DeepEquals, tokens)
+}
+
+func (s *MySuite) TestResumeTokensEmpty(c *C) {
+	encoded, err := m.EncodeResumeTokens(map[string]interface{}{})
+	c.Check(err, IsNil)
+	c.Check(encoded, Equals, "{}")
+
+	decoded, err := m.MoresqlMetadata{}.DecodeResumeTokens()
+	c.Check(err, IsNil)
+	c.Check(decoded, HasLen, 0)
+}
+
+func (s *MySuite) TestCheckpointTrackerLowWatermark(c *C) {
+	var safe []uint32
+	tracker := m.NewCheckpointTracker(func(op *gtm.Op) {
+		safe = append(safe, op.Timestamp.I)
+	})
+	op := func(i uint32) *gtm.Op {
+		return &gtm.Op{Timestamp: primitive.Timestamp{T: 1485144398, I: i}}
+	}
+	first := tracker.Track(op(1), 2)
+	second := tracker.Track(op(2), 1)
+	third := tracker.Track(op(3), 1)
+
+	// A fast worker finishing later ops must not move the watermark
+	tracker.Ack(third)
+	tracker.Ack(second)
+	tracker.Ack(first)
+	c.Check(safe, HasLen, 0)
+	c.Check(tracker.InFlight(), Equals, 3)
+
+	// Second export commits the first op, everything is now safe
+	tracker.Ack(first)
+	c.Check(safe, DeepEquals, []uint32{1, 2, 3})
+	c.Check(tracker.InFlight(), Equals, 0)
+
+	// Ops without any matching export are immediately safe
+	tracker.Track(op(4), 0)
+	c.Check(safe, DeepEquals, []uint32{1, 2, 3, 4})
+}
+
+func (s *MySuite) TestCheckpointTrackerLimit(c *C) {
+	var safe []*gtm.Op
+	tracker := m.NewCheckpointTracker(func(op *gtm.Op) {
+		safe = append(safe, op)
+	})
+	tracker.SetLimit(2)
+	op := &gtm.Op{Namespace: "db.users", Timestamp: primitive.Timestamp{T: 1485144398, I: 1}, Doc: map[string]interface{}{"name": "a"}}
+	first := tracker.Track(op, 1)
+	c.Check(tracker.Full(), Equals, false)
+	tracker.Track(op, 1)
+	c.Check(tracker.Full(), Equals, true)
+
+	tracker.Ack(first)
+	c.Check(tracker.Full(), Equals, false)
+	select {
+	case <-tracker.Freed():
+	default:
+		c.Fatal("tracker did not signal the freed op")
+	}
+
+	// Only the position of the op is kept, not its document
+	c.Assert(safe, HasLen, 1)
+	c.Check(safe[0].GetDatabase(), Equals, "db")
+	c.Check(safe[0].Timestamp, Equals, op.Timestamp)
+	c.Check(safe[0].Doc, IsNil)
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	_ "expvar"
+	"context"
 	"fmt"
 	"os"
 
@@ -25,5 +25,8 @@ func usage() func() {
 
 func main() {
 	flag.Usage = usage()
-	moresql.Run()
+	if err := moresql.Run(context.Background()); err != nil {
+		fmt.Fprintf(os.Stderr, "moresql: %s\n", err)
+		os.Exit(1)
+	}
 }
@@ -4,7 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"os"
+	"path/filepath"
 	"regexp"
 
 	"strings"
@@ -17,7 +17,7 @@ func LoadConfigString(s string) (Config, error) {
 	var configDelayed ConfigDelayed
 	err := json.Unmarshal([]byte(s), &configDelayed)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, fmt.Errorf("unable to decode config %s", err)
 	}
 	for k, v := range configDelayed {
 		db := DB{}
@@ -31,7 +31,7 @@ func LoadConfigString(s string) (Config, error) {
 			coll := Collection{Name: v.Name, Schema: schema, ExtraProps: v.ExtraProps, OrderedCols: v.OrderedCols, Exclude: v.Exclude, AllField: v.AllField, ConditionField: v.ConditionField, ConditionValue: v.ConditionValue}
 			fields, err := JsonToFields(string(v.Fields))
 			if err != nil {
-				log.Warnf("JSON Config decoding error: ", err)
+				log.Warnf("JSON Config decoding error: %s", err)
 				return nil, fmt.Errorf("unable to decode %s", err)
 			}
 			coll.Fields = fields
@@ -42,18 +42,18 @@ func LoadConfigString(s string) (Config, error) {
 	return config, nil
 }
 
-func LoadConfig(path string) Config {
+// LoadConfig reads a moresql.json file, or a MoSQL collections.yml
+// when path ends in .yml or .yaml
+func LoadConfig(path string) (Config, error) {
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
-		log.WithFields(log.Fields{"path": path, "error": err.Error()}).Error("load_config")
-		os.Exit(1)
+		return nil, err
 	}
-	config, err := LoadConfigString(string(b))
-	if err != nil {
-		log.WithFields(log.Fields{"error": err.Error()}).Error("load_config_string")
-		os.Exit(1)
+	load := LoadConfigString
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yml" || ext == ".yaml" {
+		load = LoadConfigYAML
 	}
-	return config
+	return load(string(b))
 }
 
 func mongoToPostgresTypeConversion(mongoType string) string {
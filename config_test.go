@@ -31,7 +31,7 @@ func (s *MySuite) TestConfigParsingForFields(c *C) {
               "name": "_id",
               "type": "id"
             },
-            "postgres": {
+            "export": {
               "name": "_id",
               "type": "text"
             }
@@ -46,7 +46,7 @@ func (s *MySuite) TestConfigParsingForFields(c *C) {
               "name": "name",
               "type": "text"
             },
-            "postgres": {
+            "export": {
               "name": "name",
               "type": "text"
             }
@@ -94,7 +94,7 @@ func (s *MySuite) TestConfigParsingFull(c *C) {
               "name": "_id",
               "type": "id"
             },
-            "postgres": {
+            "export": {
               "name": "_id",
               "type": "text"
             }
@@ -104,7 +104,7 @@ func (s *MySuite) TestConfigParsingFull(c *C) {
               "name": "bio",
               "type": "text"
             },
-            "postgres": {
+            "export": {
               "name": "bio",
               "type": "text"
             }
@@ -124,7 +124,7 @@ func (s *MySuite) TestConfigParsingFull(c *C) {
 }
           `
 
-	expected1 := m.Config{"company-production": m.DB{Collections: m.Collections{"accounts": m.Collection{Name: "users", Fields: m.Fields{"_id": m.Field{Mongo: m.Mongo{Name: "_id", Type: "id"}, Export: m.Export{Name: "_id", Type: "text"}}, "bio": m.Field{Mongo: m.Mongo{Name: "bio", Type: "text"}, Export: m.Export{Name: "bio", Type: "text"}}}}, "campaigns": m.Collection{Name: "campaigns", Fields: m.Fields{"_id": m.Field{Mongo: m.Mongo{Name: "_id", Type: "id"}, Export: m.Export{Name: "_id", Type: "text"}}, "created_at": m.Field{Mongo: m.Mongo{Name: "created_at", Type: "text"}, Export: m.Export{Name: "created_at", Type: "text"}}}}}}}
+	expected1 := m.Config{"company-production": m.DB{Collections: m.Collections{"accounts": m.Collection{Name: "users", Schema: "public", Fields: m.Fields{"_id": m.Field{Mongo: m.Mongo{Name: "_id", Type: "id"}, Export: m.Export{Name: "_id", Type: "text"}}, "bio": m.Field{Mongo: m.Mongo{Name: "bio", Type: "text"}, Export: m.Export{Name: "bio", Type: "text"}}}}, "campaigns": m.Collection{Name: "campaigns", Schema: "public", Fields: m.Fields{"_id": m.Field{Mongo: m.Mongo{Name: "_id", Type: "id"}, Export: m.Export{Name: "_id", Type: "text"}}, "created_at": m.Field{Mongo: m.Mongo{Name: "created_at", Type: "text"}, Export: m.Export{Name: "created_at", Type: "text"}}}}}}}
 
 	shorthand := `
 {
@@ -163,3 +163,28 @@ func (s *MySuite) TestConfigParsingFull(c *C) {
 		c.Check(err, Equals, nil)
 	}
 }
+
+func (s *MySuite) TestDiffConfig(c *C) {
+	previous := m.Config{
+		"app": m.DB{Collections: m.Collections{
+			"users":  m.Collection{Name: "users", Fields: m.Fields{"_id": BuildFieldFromId("_id")}},
+			"orders": m.Collection{Name: "orders"},
+			"events": m.Collection{Name: "events"},
+		}},
+		"old": m.DB{Collections: m.Collections{"logs": m.Collection{Name: "logs"}}},
+	}
+	next := m.Config{
+		"app": m.DB{Collections: m.Collections{
+			"users":  m.Collection{Name: "users", Fields: m.Fields{"_id": BuildFieldFromId("_id"), "name": BuildTextField("name")}},
+			"orders": m.Collection{Name: "orders"},
+			"carts":  m.Collection{Name: "carts"},
+		}},
+		"new": m.DB{Collections: m.Collections{"logs": m.Collection{Name: "logs"}}},
+	}
+	diff := m.DiffConfig(previous, next)
+	c.Check(diff.Added, DeepEquals, []string{"app.carts", "new.logs"})
+	c.Check(diff.Removed, DeepEquals, []string{"app.events", "old.logs"})
+	c.Check(diff.Changed, DeepEquals, []string{"app.users"})
+	c.Check(diff.Empty(), Equals, false)
+	c.Check(m.DiffConfig(next, next).Empty(), Equals, true)
+}
@@ -0,0 +1,120 @@
+package moresql
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// mosqlConfig mirrors the MoSQL collections.yml format,
+// db -> collection -> definition
+type mosqlConfig map[string]map[string]mosqlCollection
+
+type mosqlCollection struct {
+	Columns []yaml.MapSlice `yaml:":columns"`
+	Meta    mosqlMeta       `yaml:":meta"`
+	Exclude []string        `yaml:":exclude"`
+}
+
+type mosqlMeta struct {
+	Table          string `yaml:":table"`
+	Schema         string `yaml:":schema"`
+	ExtraProps     string `yaml:":extra_props"`
+	AllField       bool   `yaml:":all_field"`
+	ConditionField string `yaml:":condition_field"`
+	ConditionValue string `yaml:":condition_value"`
+	// Export is read only to warn it is ignored, exports apply
+	// to every collection and are chosen with -exports
+	Export string `yaml:":export"`
+}
+
+// LoadConfigYAML parses a MoSQL style collections.yml directly into
+// Config, producing the same result as running it through
+// bin/convert_config_from_mosql_to_moresql and LoadConfigString.
+func LoadConfigYAML(s string) (Config, error) {
+	var mosql mosqlConfig
+	if err := yaml.Unmarshal([]byte(s), &mosql); err != nil {
+		return nil, err
+	}
+	config := Config{}
+	for dbName, collections := range mosql {
+		db := DB{Collections: Collections{}}
+		for name, v := range collections {
+			if v.Meta.Export != "" {
+				log.WithFields(log.Fields{"collection": dbName + "." + name, "export": v.Meta.Export}).Warn("Ignoring :export:, list the exports with -exports")
+			}
+			schema := v.Meta.Schema
+			if schema == "" {
+				schema = "public"
+			}
+			coll := Collection{
+				Name:           v.Meta.Table,
+				Schema:         schema,
+				ExtraProps:     v.Meta.ExtraProps,
+				Exclude:        v.Exclude,
+				AllField:       v.Meta.AllField,
+				ConditionField: v.Meta.ConditionField,
+				ConditionValue: v.Meta.ConditionValue,
+			}
+			fields, orderedCols, err := mosqlColumnsToFields(v.Columns)
+			if err != nil {
+				return nil, fmt.Errorf("%s.%s: %s", dbName, name, err)
+			}
+			coll.Fields = fields
+			coll.OrderedCols = orderedCols
+			db.Collections[name] = coll
+		}
+		config[dbName] = db
+	}
+	return config, nil
+}
+
+// mosqlColumnsToFields converts :columns: entries into Fields. Entries are
+// either the longhand `- name:` with sibling :source: and :type: keys or
+// the shorthand `- name: TYPE`. Only longhand columns are ordered.
+func mosqlColumnsToFields(columns []yaml.MapSlice) (Fields, []string, error) {
+	fields := Fields{}
+	orderedCols := []string{}
+	for _, column := range columns {
+		if len(column) == 0 {
+			continue
+		}
+		if first := column[0]; first.Value != nil {
+			name := fmt.Sprintf("%v", first.Key)
+			var str string
+			switch v := first.Value.(type) {
+			case yaml.MapSlice, []interface{}:
+				return nil, nil, fmt.Errorf("column %s: shorthand type must be a scalar, got %v", name, v)
+			default:
+				// YAML reads scalars such as 2 or yes as numbers and bools
+				str = fmt.Sprintf("%v", v)
+			}
+			fields[name] = Field{
+				Mongo{name, str},
+				Export{normalizeDotNotationToPostgresNaming(name), mongoToPostgresTypeConversion(str)},
+			}
+			continue
+		}
+
+		var name, source, typ string
+		for _, item := range column {
+			key := fmt.Sprintf("%v", item.Key)
+			switch {
+			case key == ":source":
+				source = fmt.Sprintf("%v", item.Value)
+			case key == ":type":
+				typ = fmt.Sprintf("%v", item.Value)
+			case item.Value == nil && !strings.HasPrefix(key, ":"):
+				name = key
+			}
+		}
+		if name == "" || source == "" {
+			return nil, nil, fmt.Errorf("column %v: requires a name and :source:", column)
+		}
+		fields[source] = Field{Mongo{source, typ}, Export{name, typ}}
+		orderedCols = append(orderedCols, name)
+	}
+	return fields, orderedCols, nil
+}
@@ -0,0 +1,116 @@
+package moresql_test
+
+import (
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestLoadConfigYAML(c *C) {
+	yml := `
+database:
+  collection:
+    :columns:
+    - id:
+      :source: _id
+      :type: TEXT
+    - time:
+      :source: time
+      :type: DOUBLE PRECISION
+    - name_first:
+      :source: name.first
+      :type: TEXT
+    - age: integer
+    :meta:
+      :table: order_notify
+      :schema: custom
+      :extra_props: JSONB
+      :condition_field: delivery
+      :condition_value: ahamove
+    :exclude:
+      - time
+  mirror:
+    :meta:
+      :table: testing
+      :all_field: true
+`
+	expected := m.Config{"database": m.DB{Collections: m.Collections{
+		"collection": m.Collection{
+			Name:   "order_notify",
+			Schema: "custom",
+			Fields: m.Fields{
+				"_id":        m.Field{Mongo: m.Mongo{Name: "_id", Type: "TEXT"}, Export: m.Export{Name: "id", Type: "TEXT"}},
+				"time":       m.Field{Mongo: m.Mongo{Name: "time", Type: "DOUBLE PRECISION"}, Export: m.Export{Name: "time", Type: "DOUBLE PRECISION"}},
+				"name.first": m.Field{Mongo: m.Mongo{Name: "name.first", Type: "TEXT"}, Export: m.Export{Name: "name_first", Type: "TEXT"}},
+				"age":        m.Field{Mongo: m.Mongo{Name: "age", Type: "integer"}, Export: m.Export{Name: "age", Type: "integer"}},
+			},
+			ExtraProps:     "JSONB",
+			OrderedCols:    []string{"id", "time", "name_first"},
+			Exclude:        []string{"time"},
+			ConditionField: "delivery",
+			ConditionValue: "ahamove",
+		},
+		"mirror": m.Collection{
+			Name:        "testing",
+			Schema:      "public",
+			Fields:      m.Fields{},
+			OrderedCols: []string{},
+			AllField:    true,
+		},
+	}}}
+	config, err := m.LoadConfigYAML(yml)
+	c.Check(err, IsNil)
+	c.Check(config, DeepEquals, expected)
+}
+
+func (s *MySuite) TestLoadConfigYAMLInvalidColumn(c *C) {
+	yml := `
+database:
+  collection:
+    :columns:
+    - id:
+      :type: TEXT
+    :meta:
+      :table: order_notify
+`
+	_, err := m.LoadConfigYAML(yml)
+	c.Check(err, ErrorMatches, "database.collection: column .* requires a name and :source:")
+}
+
+func (s *MySuite) TestLoadConfigYAMLShorthandScalars(c *C) {
+	yml := `
+database:
+  collection:
+    :columns:
+    - count: 2
+    :meta:
+      :table: order_notify
+`
+	config, err := m.LoadConfigYAML(yml)
+	c.Assert(err, IsNil)
+	fields := config["database"].Collections["collection"].Fields
+	c.Check(fields["count"].Export, Equals, m.Export{Name: "count", Type: "2"})
+
+	yml = `
+database:
+  collection:
+    :columns:
+    - tags: [a, b]
+    :meta:
+      :table: order_notify
+`
+	_, err = m.LoadConfigYAML(yml)
+	c.Check(err, ErrorMatches, "database.collection: column tags: shorthand type must be a scalar.*")
+}
+
+func (s *MySuite) TestLoadConfigYAMLIgnoresExport(c *C) {
+	yml := `
+database:
+  collection:
+    :meta:
+      :table: testing
+      :export: mongo
+`
+	config, err := m.LoadConfigYAML(yml)
+	c.Assert(err, IsNil)
+	c.Check(config["database"].Collections["collection"].Name, Equals, "testing")
+}
@@ -5,33 +5,52 @@ import (
 	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"math"
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func GetMongoConnection(url string) *mongo.Client {
+// GetMongoConnection connects to url using the -ssl-* flags
+// and pings it so that a bad url or certificate fails early
+func GetMongoConnection(ctx context.Context, url string, env Env) (*mongo.Client, error) {
 	clientOptions := options.Client().ApplyURI(url)
-	client, err := mongo.Connect(context.TODO(), clientOptions)
+	if env.UseSSL() {
+		config, err := env.TLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		clientOptions.SetTLSConfig(config)
+	}
+	client, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("connecting to mongo: %s", err)
+	}
+	ping, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+	if err := client.Ping(ping, nil); err != nil {
+		client.Disconnect(context.Background())
+		return nil, fmt.Errorf("connecting to mongo: %s", err)
 	}
-	return client
+	return client, nil
 }
 
-func GetPostgresConnection(env Env) (pg *sqlx.DB) {
-	var err error
-	pg, err = sqlx.Connect("postgres", env.urls.postgres)
+// GetPostgresConnection connects to POSTGRES_URL using the -ssl-* flags
+func GetPostgresConnection(env Env) (*sqlx.DB, error) {
+	conn, err := PostgresSSLURL(env.urls.postgres, env)
+	if err != nil {
+		return nil, err
+	}
+	pg, err := sqlx.Connect("postgres", conn)
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("connecting to postgres: %s", err)
 	}
 	setupPgDefaults(pg, env.postgresMaxOpenConns)
-	return
+	return pg, nil
 }
 
 // setupPgDefaults: Set safe cap so workers do not overwhelm server
@@ -0,0 +1,433 @@
+package moresql
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rwynn/gtm"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// deadLettersPostgres is the -dead-letters value storing
+// failed ops in the moresql_dead_letters table
+const deadLettersPostgres = "postgres"
+
+// deadLetterPageSize is how many dead letters Drain
+// loads from moresql_dead_letters at once
+const deadLetterPageSize = 500
+
+// DeadLetter is an op that an export failed to write. DocID keeps the
+// op's _id as canonical extended json so its bson type survives, Payload
+// is the sanitized data that was handed to the export.
+type DeadLetter struct {
+	ID        int64           `db:"id" json:"-"`
+	AppName   string          `db:"app_name" json:"app_name"`
+	Namespace string          `db:"namespace" json:"namespace"`
+	DocID     string          `db:"doc_id" json:"doc_id"`
+	Operation string          `db:"operation" json:"operation"`
+	Epoch     int64           `db:"epoch" json:"epoch"`
+	Ordinal   int64           `db:"ordinal" json:"ordinal"`
+	Payload   json.RawMessage `db:"payload" json:"payload"`
+	Export    string          `db:"export" json:"export"`
+	Error     string          `db:"error" json:"error"`
+	FailedAt  time.Time       `db:"failed_at" json:"failed_at"`
+}
+
+// NewDeadLetter records that export failed to write op with data
+func NewDeadLetter(appName string, op *gtm.Op, export string, data map[string]interface{}, cause error) (DeadLetter, error) {
+	id, err := bson.MarshalExtJSON(bson.M{"_id": op.Id}, true, false)
+	if err != nil {
+		return DeadLetter{}, err
+	}
+	payload := make(map[string]interface{})
+	for k, v := range data {
+		// SanitizeData marshals objects and arrays for postgres,
+		// keep them readable instead of base64 encoded
+		if b, ok := v.([]byte); ok && json.Valid(b) {
+			v = json.RawMessage(b)
+		}
+		payload[k] = v
+	}
+	encoded, err := json.Marshal(payload)
+	if err != nil {
+		return DeadLetter{}, err
+	}
+	return DeadLetter{
+		AppName:   appName,
+		Namespace: op.Namespace,
+		DocID:     string(id),
+		Operation: op.Operation,
+		Epoch:     int64(op.Timestamp.T),
+		Ordinal:   int64(op.Timestamp.I),
+		Payload:   encoded,
+		Export:    export,
+		Error:     cause.Error(),
+		FailedAt:  time.Now(),
+	}, nil
+}
+
+// Op rebuilds the op the dead letter was recorded for, without its document
+func (d DeadLetter) Op() (*gtm.Op, error) {
+	var doc bson.M
+	if err := bson.UnmarshalExtJSON([]byte(d.DocID), true, &doc); err != nil {
+		return nil, err
+	}
+	return &gtm.Op{
+		Id:        doc["_id"],
+		Namespace: d.Namespace,
+		Operation: d.Operation,
+		Timestamp: primitive.Timestamp{T: uint32(d.Epoch), I: uint32(d.Ordinal)},
+	}, nil
+}
+
+// Data decodes the payload into the form SanitizeData
+// produces for the dead letter's export
+func (d DeadLetter) Data() (map[string]interface{}, error) {
+	data := make(map[string]interface{})
+	if err := json.Unmarshal(d.Payload, &data); err != nil {
+		return nil, err
+	}
+	if d.Export == mongoExport {
+		return data, nil
+	}
+	for k, v := range data {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			data[k] = b
+		}
+	}
+	return data, nil
+}
+
+// DeadLetterStore persists dead letters until they are replayed
+type DeadLetterStore interface {
+	Put(d DeadLetter) error
+	// Drain calls fn with every stored dead letter in the order they
+	// were put, removing those for which fn returns nil
+	Drain(fn func(d DeadLetter) error) error
+	Close() error
+}
+
+// OpenDeadLetters returns the store configured by -dead-letters,
+// or nil when failed ops are not kept
+func OpenDeadLetters(env Env, pg *sqlx.DB) (DeadLetterStore, error) {
+	switch env.deadLetters {
+	case "":
+		return nil, nil
+	case deadLettersPostgres:
+		if pg == nil {
+			return nil, fmt.Errorf("postgres dead letters require POSTGRES_URL")
+		}
+		return newPgDeadLetters(pg, env.appName)
+	default:
+		return newFileDeadLetters(env.deadLetters)
+	}
+}
+
+// pgDeadLetters keeps dead letters in moresql_dead_letters,
+// creating the table on first use
+type pgDeadLetters struct {
+	pg      *sqlx.DB
+	appName string
+}
+
+func newPgDeadLetters(pg *sqlx.DB, appName string) (*pgDeadLetters, error) {
+	q := Queries{}
+	if _, err := pg.Exec(q.CreateDeadLettersTable()); err != nil {
+		return nil, err
+	}
+	return &pgDeadLetters{pg: pg, appName: appName}, nil
+}
+
+func (s *pgDeadLetters) Put(d DeadLetter) error {
+	q := Queries{}
+	// payload is sent as text as pq sends []byte as bytea
+	_, err := s.pg.Exec(q.SaveDeadLetter(), d.AppName, d.Namespace, d.DocID, d.Operation, d.Epoch, d.Ordinal, string(d.Payload), d.Export, d.Error, d.FailedAt)
+	return err
+}
+
+func (s *pgDeadLetters) Drain(fn func(d DeadLetter) error) error {
+	q := Queries{}
+	var after int64
+	for {
+		letters := []DeadLetter{}
+		if err := s.pg.Select(&letters, q.GetDeadLetters(), s.appName, after, deadLetterPageSize); err != nil {
+			return err
+		}
+		for _, d := range letters {
+			after = d.ID
+			if err := fn(d); err != nil {
+				continue
+			}
+			if _, err := s.pg.Exec(q.DeleteDeadLetter(), d.ID); err != nil {
+				return err
+			}
+		}
+		if len(letters) < deadLetterPageSize {
+			return nil
+		}
+	}
+}
+
+// Close is a noop as the connection is owned by Run
+func (s *pgDeadLetters) Close() error { return nil }
+
+// fileDeadLetters appends dead letters to a local NDJSON file
+type fileDeadLetters struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func newFileDeadLetters(path string) (*fileDeadLetters, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileDeadLetters{path: path, file: file}, nil
+}
+
+func (s *fileDeadLetters) Put(d DeadLetter) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	return s.append(b)
+}
+
+// Drain moves the file aside and puts back the dead letters fn did not
+// accept. The lock is only held to move the file, so Put isn't blocked
+// for the whole replay. A replay that stopped halfway is resumed.
+func (s *fileDeadLetters) Drain(fn func(d DeadLetter) error) error {
+	replaying := s.path + ".replaying"
+	s.mu.Lock()
+	_, err := os.Stat(replaying)
+	if os.IsNotExist(err) {
+		err = s.rotate(replaying)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(replaying)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		var d DeadLetter
+		if err := json.Unmarshal(line, &d); err != nil {
+			return err
+		}
+		if fn(d) == nil {
+			continue
+		}
+		if err := s.append(line); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return os.Remove(replaying)
+}
+
+// rotate renames the file to path and starts a new one,
+// it must be called while holding s.mu
+func (s *fileDeadLetters) rotate(path string) error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(s.path, path); err != nil {
+		return err
+	}
+	var err error
+	s.file, err = os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	return err
+}
+
+func (s *fileDeadLetters) append(line []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(line); err != nil {
+		return err
+	}
+	if _, err := s.file.Write([]byte("\n")); err != nil {
+		return err
+	}
+	return s.file.Sync()
+}
+
+func (s *fileDeadLetters) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// saveDeadLetter stores op as failed by its export so the Tailer can
+// move on. It returns nil once stored, otherwise the export's error.
+func (t *Tailer) saveDeadLetter(op Op, data map[string]interface{}, cause error) error {
+	d, err := NewDeadLetter(t.env.appName, op.data, op.export, data, cause)
+	if err == nil {
+		err = t.deadLetters.Put(d)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "namespace": op.data.Namespace, "id": op.data.Id}).Error("Unable to save dead letter")
+		return cause
+	}
+	log.WithFields(log.Fields{
+		"namespace": d.Namespace,
+		"id":        op.data.Id,
+		"export":    d.Export,
+		"error":     d.Error,
+	}).Warn("Saved dead letter")
+	return nil
+}
+
+func (t *Tailer) closeDeadLetters() {
+	if t.deadLetters == nil {
+		return
+	}
+	if err := t.deadLetters.Close(); err != nil {
+		log.WithField("error", err).Error("Unable to close dead letters")
+	}
+}
+
+// ReplayDeadLetters re-applies every dead letter of -app-name through its
+// export. Those that succeed are removed, the rest stay for a later replay.
+// The document is read again from mongo rather than taken from the stored
+// payload, so a replay never overwrites what a later op already wrote.
+func ReplayDeadLetters(ctx context.Context, o Options) error {
+	env := o.Env
+	if o.Mongo == nil {
+		return fmt.Errorf("-replay-dead-letters requires MONGO_URL to read the documents again")
+	}
+	store, err := OpenDeadLetters(env, o.Postgres)
+	if err != nil {
+		return fmt.Errorf("opening dead letters: %s", err)
+	}
+	if store == nil {
+		return fmt.Errorf("-replay-dead-letters requires -dead-letters")
+	}
+	defer store.Close()
+
+	// Writes are not batched so a dead letter is only
+	// removed once its export has committed it
+	env.batchSize = 0
+	eo := ExporterOptions{Config: o.Config, Postgres: o.Postgres, Mongo: o.MongoExport, Env: env, Retry: NewRetryPolicy(env), Context: ctx}
+	exporters := make(map[string]Exporter)
+	st := &FullSyncer{Config: o.Config}
+	replayed, failed := 0, 0
+	err = store.Drain(func(d DeadLetter) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := replayDeadLetter(ctx, o.Mongo, st, exporters, eo, d)
+		if err != nil {
+			failed++
+			log.WithFields(log.Fields{"namespace": d.Namespace, "id": d.DocID, "export": d.Export, "error": err}).Error("Unable to replay dead letter")
+			return err
+		}
+		replayed++
+		return nil
+	})
+	for _, exporter := range exporters {
+		exporter.Close()
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		return fmt.Errorf("replaying dead letters: %s", err)
+	}
+	log.WithFields(log.Fields{"replayed": replayed, "failed": failed}).Info("Replayed dead letters")
+	if failed > 0 {
+		return fmt.Errorf("%d dead letters could not be replayed", failed)
+	}
+	return nil
+}
+
+func replayDeadLetter(ctx context.Context, client *mongo.Client, st *FullSyncer, exporters map[string]Exporter, o ExporterOptions, d DeadLetter) error {
+	exporter, ok := exporters[d.Export]
+	if !ok {
+		var err error
+		if exporter, err = NewExporter(d.Export, o); err != nil {
+			return err
+		}
+		exporters[d.Export] = exporter
+	}
+	op, err := currentOp(ctx, client, d)
+	if err != nil {
+		return err
+	}
+	s, coll := st.statementFromDbCollection(op.GetDatabase(), op.GetCollection())
+	if op.Data != nil {
+		op = EnsureOpHasAllFields(op, s.mongoFields())
+	}
+	data, err := SanitizeData(coll, op, len(coll.ExtraProps) > 0, d.Export == mongoExport)
+	if err != nil {
+		return err
+	}
+	switch {
+	case data == nil:
+		// Excluded or no longer matching the condition
+		return nil
+	case op.IsDelete() && !o.Env.allowDeletes:
+		return nil
+	case op.IsDelete():
+		err = exporter.Delete(op, coll, data)
+	case o.Env.justInsert || op.IsInsert():
+		err = exporter.Insert(op, coll, data)
+	default:
+		err = exporter.Update(op, coll, data)
+	}
+	if err != nil {
+		return err
+	}
+	return exporter.Flush()
+}
+
+// currentOp rebuilds the op of d with the document as it is now in
+// mongo. A document deleted since is replayed as a delete, and one
+// that exists again after a failed delete as an update.
+func currentOp(ctx context.Context, client *mongo.Client, d DeadLetter) (*gtm.Op, error) {
+	op, err := d.Op()
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]interface{}
+	err = client.Database(op.GetDatabase()).Collection(op.GetCollection()).FindOne(ctx, bson.M{"_id": op.Id}).Decode(&doc)
+	switch {
+	case err == mongo.ErrNoDocuments:
+		op.Operation = "d"
+	case err != nil:
+		return nil, fmt.Errorf("reading %s %s: %s", d.Namespace, d.DocID, err)
+	default:
+		op.Data = doc
+		if !op.IsInsert() {
+			op.Operation = "u"
+		}
+	}
+	return op, nil
+}
@@ -0,0 +1,83 @@
+package moresql_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/rwynn/gtm"
+	m "github.com/zph/moresql"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestDeadLetterRoundTrip(c *C) {
+	oid := primitive.NewObjectID()
+	op := &gtm.Op{
+		Id:        oid,
+		Namespace: "db.categories",
+		Operation: "u",
+		Timestamp: primitive.Timestamp{T: 1500000000, I: 3},
+	}
+	data := map[string]interface{}{"id": oid.Hex(), "count": 2.0, "tags": []byte(`["a","b"]`), "name": nil}
+	d, err := m.NewDeadLetter("moresql", op, "postgres", data, errors.New("pq: boom"))
+	c.Assert(err, IsNil)
+	c.Check(d.Namespace, Equals, "db.categories")
+	c.Check(d.Export, Equals, "postgres")
+	c.Check(d.Error, Equals, "pq: boom")
+	c.Check(string(d.Payload), Equals, `{"count":2,"id":"`+oid.Hex()+`","name":null,"tags":["a","b"]}`)
+
+	replayed, err := d.Op()
+	c.Assert(err, IsNil)
+	c.Check(replayed.Id, Equals, oid)
+	c.Check(replayed.GetDatabase(), Equals, "db")
+	c.Check(replayed.GetCollection(), Equals, "categories")
+	c.Check(replayed.IsUpdate(), Equals, true)
+	c.Check(replayed.Timestamp, Equals, op.Timestamp)
+
+	payload, err := d.Data()
+	c.Assert(err, IsNil)
+	c.Check(payload, DeepEquals, map[string]interface{}{"id": oid.Hex(), "count": 2.0, "tags": []byte(`["a","b"]`), "name": nil})
+}
+
+func (s *MySuite) TestFileDeadLettersDrain(c *C) {
+	path := filepath.Join(c.MkDir(), "dead.ndjson")
+	env, err := m.ParseEnv([]string{"-dead-letters=" + path})
+	c.Assert(err, IsNil)
+	store, err := m.OpenDeadLetters(env, nil)
+	c.Assert(err, IsNil)
+	defer store.Close()
+
+	for _, ns := range []string{"db.a", "db.b", "db.c"} {
+		op := &gtm.Op{Id: primitive.NewObjectID(), Namespace: ns, Operation: "i"}
+		d, err := m.NewDeadLetter("moresql", op, "postgres", map[string]interface{}{}, errors.New("boom"))
+		c.Assert(err, IsNil)
+		c.Assert(store.Put(d), IsNil)
+	}
+
+	seen := []string{}
+	err = store.Drain(func(d m.DeadLetter) error {
+		seen = append(seen, d.Namespace)
+		if d.Namespace == "db.b" {
+			return errors.New("still failing")
+		}
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Check(seen, DeepEquals, []string{"db.a", "db.b", "db.c"})
+	_, err = os.Stat(path + ".replaying")
+	c.Check(os.IsNotExist(err), Equals, true)
+
+	// Only the dead letter that failed is kept, and Put still appends
+	op := &gtm.Op{Id: primitive.NewObjectID(), Namespace: "db.d", Operation: "i"}
+	d, err := m.NewDeadLetter("moresql", op, "postgres", map[string]interface{}{}, errors.New("boom"))
+	c.Assert(err, IsNil)
+	c.Assert(store.Put(d), IsNil)
+	seen = []string{}
+	err = store.Drain(func(d m.DeadLetter) error {
+		seen = append(seen, d.Namespace)
+		return nil
+	})
+	c.Assert(err, IsNil)
+	c.Check(seen, DeepEquals, []string{"db.b", "db.d"})
+}
@@ -3,14 +3,19 @@ package moresql
 import (
 	"context"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"os"
+	"sync"
 	"time"
 
+	"github.com/jmoiron/sqlx"
+	"github.com/paulbellamy/ratecounter"
 	"github.com/rwynn/gtm"
 	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
@@ -23,14 +28,43 @@ func getTypeField(fields map[string]Field, field string) string {
 	return ""
 }
 
-func (t *Tailer) exportCSV(op *gtm.Op, coll Collection, data map[string]interface{}) {
-	clientsFile, _ := os.OpenFile(t.env.csvPathFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, os.ModePerm)
+// csvExporter appends each inserted or updated row
+// to the file given by -csv-path-file
+type csvExporter struct {
+	mu     sync.Mutex
+	file   *os.File
+	writer *csv.Writer
+}
+
+func newCSVExporter(o ExporterOptions) (Exporter, error) {
+	if len(o.Env.csvPathFile) == 0 {
+		return nil, errors.New("csv export requires -csv-path-file")
+	}
+	file, err := os.OpenFile(o.Env.csvPathFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	return &csvExporter{file: file, writer: csv.NewWriter(file)}, nil
+}
+
+func (e *csvExporter) Insert(op *gtm.Op, coll Collection, data map[string]interface{}) error {
+	return e.write(coll, data)
+}
+
+func (e *csvExporter) Update(op *gtm.Op, coll Collection, data map[string]interface{}) error {
+	return e.write(coll, data)
+}
 
+// Delete is a noop as a csv dump is append only
+func (e *csvExporter) Delete(op *gtm.Op, coll Collection, data map[string]interface{}) error {
+	return nil
+}
+
+func (e *csvExporter) write(coll Collection, data map[string]interface{}) error {
 	// Layout and GMT+7
 	layout := "2006-01-02 15:04:05Z"
 	loc := time.FixedZone("UTC+7", 7*60*60)
 
-	w := csv.NewWriter(clientsFile)
 	var record []string
 	for _, v := range coll.OrderedCols {
 		if data[v] == nil {
@@ -46,124 +80,246 @@ func (t *Tailer) exportCSV(op *gtm.Op, coll Collection, data map[string]interfac
 			record = append(record, fmt.Sprintf("%f", vv))
 
 		case string:
-			record = append(record, fmt.Sprintf("%s", vv))
+			record = append(record, vv)
 		default:
 			record = append(record, fmt.Sprintf("%v", vv))
 		}
 	}
 	if len(record) != len(coll.OrderedCols) {
-		return
+		return nil
 	}
 
-	w.Write(record)
-	w.Flush()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.writer.Write(record); err != nil {
+		return err
+	}
+	e.writer.Flush()
+	return e.writer.Error()
+}
 
-	switch {
-	case op.IsInsert():
-		t.counters[csvExport].insert.Incr(1)
-	case op.IsUpdate():
-		t.counters[csvExport].update.Incr(1)
-	default:
-		t.counters[csvExport].skipped.Incr(1)
+func (e *csvExporter) Flush() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+func (e *csvExporter) Close() error {
+	if err := e.Flush(); err != nil {
+		return err
 	}
+	return e.file.Close()
+}
+
+// postgresExporter upserts rows into the table
+// described by the collection's config. With -batch-size
+// writes are grouped per table and sent on Flush.
+type postgresExporter struct {
+	pg         *sqlx.DB
+	justInsert bool
+	batch      *pgBatcher
+	retry      RetryPolicy
+	ctx        context.Context
 }
 
-func (t *Tailer) exportPostgres(o Statement, op *gtm.Op, data map[string]interface{}, workerType string) {
-	payload := map[string]interface{}{
-		"action":     op.Operation,
-		"collection": op.GetCollection(),
-		"timestamp":  op.Timestamp,
-		"data":       data,
+func newPostgresExporter(o ExporterOptions) (Exporter, error) {
+	if o.Postgres == nil {
+		return nil, errors.New("postgres export requires POSTGRES_URL")
+	}
+	e := &postgresExporter{pg: o.Postgres, justInsert: o.Env.justInsert, retry: o.Retry, ctx: o.context()}
+	if o.Env.batchSize > 1 {
+		e.batch = newPgBatcher(e.ctx, o.Postgres, o.Env.batchSize, o.Env.justInsert, o.Retry)
+		e.batch.deadLetters = o.DeadLetters
+		e.batch.appName = o.Env.appName
+		e.batch.skipError = o.Env.skipError
 	}
+	return e, nil
+}
 
-	if t.env.justInsert {
-		t.counters[postgresExport].insert.Incr(1)
-		log.WithFields(log.Fields{
-			"data":  data,
-			"query": o.BuildInsert(),
-		}).Debug("just insert")
-		_, err := t.pg.NamedExec(o.BuildInsert(), data)
-		t.logFn(err, workerType, payload)
-		return
+func (e *postgresExporter) Insert(op *gtm.Op, coll Collection, data map[string]interface{}) error {
+	if e.batch != nil {
+		return e.batch.Upsert(op, coll, data)
+	}
+	o := Statement{coll}
+	query := o.BuildUpsert()
+	if e.justInsert {
+		query = o.BuildInsert()
 	}
+	return e.exec("insert", query, data)
+}
 
-	switch {
-	case op.IsInsert():
-		t.counters[postgresExport].insert.Incr(1)
-		log.WithFields(log.Fields{
-			"data":  data,
-			"query": o.BuildUpsert(),
-		}).Debug("insert")
-		_, err := t.pg.NamedExec(o.BuildUpsert(), data)
-		t.logFn(err, workerType, payload)
-	case op.IsUpdate():
-		t.counters[postgresExport].update.Incr(1)
-		log.WithFields(log.Fields{
-			"data":  data,
-			"query": o.BuildUpsert(),
-		}).Debug("update")
-		_, err := t.pg.NamedExec(o.BuildUpsert(), data)
-		t.logFn(err, workerType, payload)
-	case op.IsDelete() && t.env.allowDeletes:
-		t.counters[postgresExport].delete.Incr(1)
-		log.WithFields(log.Fields{
-			"data":  data,
-			"query": o.BuildDelete(),
-		}).Debug("delete")
-		_, err := t.pg.NamedExec(o.BuildDelete(), data)
-		t.logFn(err, workerType, payload)
-	default:
-		t.counters[postgresExport].skipped.Incr(1)
+func (e *postgresExporter) Update(op *gtm.Op, coll Collection, data map[string]interface{}) error {
+	if e.batch != nil {
+		return e.batch.Upsert(op, coll, data)
 	}
+	o := Statement{coll}
+	return e.exec("update", o.BuildUpsert(), data)
 }
 
-func (t *Tailer) exportMongo(op *gtm.Op, data map[string]interface{}, workerType string) {
-	collection := t.clientExport.Database(op.GetDatabase()).Collection(op.GetCollection())
-	payload := map[string]interface{}{
-		"action":     op.Operation,
-		"collection": op.GetCollection(),
-		"database":   op.GetDatabase(),
-		"timestamp":  op.Timestamp,
-		"data":       data,
+func (e *postgresExporter) Delete(op *gtm.Op, coll Collection, data map[string]interface{}) error {
+	if e.batch != nil {
+		return e.batch.Delete(op, coll, data)
 	}
+	o := Statement{coll}
+	return e.exec("delete", o.BuildDelete(), data)
+}
 
-	delete(data, "_id")
+func (e *postgresExporter) exec(action string, query string, data map[string]interface{}) error {
+	log.WithFields(log.Fields{
+		"data":  data,
+		"query": query,
+	}).Debug(action)
+	return e.retry.Do(e.ctx, func() error {
+		_, err := e.pg.NamedExec(query, data)
+		return err
+	})
+}
 
-	if t.env.justInsert {
-		t.counters[mongoExport].insert.Incr(1)
-		// delete(data, "_id")
-		_, err := collection.InsertOne(context.TODO(), data)
-		t.logFn(err, workerType, payload)
-		return
+// Flush writes any batched rows, it is a noop without -batch-size
+func (e *postgresExporter) Flush() error {
+	if e.batch == nil {
+		return nil
 	}
+	return e.batch.Flush()
+}
 
-	switch {
-	case op.IsInsert():
-		t.counters[mongoExport].insert.Incr(1)
-		_, err := collection.UpdateOne(
-			context.Background(),
-			bson.M{"_id": op.Id},
-			bson.D{{"$set", data}},
-			options.Update().SetUpsert(true))
-		t.logFn(err, workerType, payload)
-	case op.IsUpdate():
-		t.counters[mongoExport].update.Incr(1)
-		_, err := collection.UpdateOne(
-			context.Background(),
+// Close is a noop as the connection is owned by Run
+func (e *postgresExporter) Close() error { return nil }
+
+// mongoExporter mirrors documents into the same db.collection
+// on the MONGO_EXPORT_URL server
+type mongoExporter struct {
+	client     *mongo.Client
+	justInsert bool
+	retry      RetryPolicy
+	ctx        context.Context
+}
+
+func newMongoExporter(o ExporterOptions) (Exporter, error) {
+	if o.Mongo == nil {
+		return nil, errors.New("mongo export requires MONGO_EXPORT_URL")
+	}
+	return &mongoExporter{client: o.Mongo, justInsert: o.Env.justInsert, retry: o.Retry, ctx: o.context()}, nil
+}
+
+func (e *mongoExporter) collection(op *gtm.Op) *mongo.Collection {
+	return e.client.Database(op.GetDatabase()).Collection(op.GetCollection())
+}
+
+func (e *mongoExporter) Insert(op *gtm.Op, coll Collection, data map[string]interface{}) error {
+	delete(data, "_id")
+	if e.justInsert {
+		return e.retry.Do(e.ctx, func() error {
+			_, err := e.collection(op).InsertOne(e.ctx, data)
+			return err
+		})
+	}
+	return e.upsert(op, data)
+}
+
+func (e *mongoExporter) Update(op *gtm.Op, coll Collection, data map[string]interface{}) error {
+	delete(data, "_id")
+	return e.upsert(op, data)
+}
+
+func (e *mongoExporter) Delete(op *gtm.Op, coll Collection, data map[string]interface{}) error {
+	return e.retry.Do(e.ctx, func() error {
+		_, err := e.collection(op).DeleteOne(e.ctx, bson.M{"_id": op.Id})
+		return err
+	})
+}
+
+func (e *mongoExporter) upsert(op *gtm.Op, data map[string]interface{}) error {
+	return e.retry.Do(e.ctx, func() error {
+		_, err := e.collection(op).UpdateOne(
+			e.ctx,
 			bson.M{"_id": op.Id},
-			bson.D{{"$set", data}},
+			bson.D{{Key: "$set", Value: data}},
 			options.Update().SetUpsert(true))
-		t.logFn(err, workerType, payload)
-	case op.IsDelete() && t.env.allowDeletes:
-		t.counters[mongoExport].delete.Incr(1)
-		_, err := collection.DeleteOne(context.Background(), bson.M{"_id": op.Id})
-		t.logFn(err, workerType, payload)
+		return err
+	})
+}
+
+// Flush is a noop as every write is sent immediately
+func (e *mongoExporter) Flush() error { return nil }
+
+// Close is a noop as the client is owned by Run
+func (e *mongoExporter) Close() error { return nil }
+
+// export routes a sanitized op to the matching Exporter func
+// and tracks it in the counters for that export once written
+func (t *Tailer) export(op Op, coll Collection, data map[string]interface{}) error {
+	exporter := t.exporters[op.export]
+	counter := t.counters[op.export]
+	db, name := op.data.GetDatabase(), op.data.GetCollection()
+	var write func(op *gtm.Op, coll Collection, data map[string]interface{}) error
+	var rate *ratecounter.RateCounter
+	var total counterVec
+	switch {
+	case t.env.justInsert || op.data.IsInsert():
+		write, rate, total = exporter.Insert, counter.insert, insertTotal
+	case op.data.IsUpdate():
+		write, rate, total = exporter.Update, counter.update, updateTotal
+	case op.data.IsDelete() && t.env.allowDeletes:
+		write, rate, total = exporter.Delete, counter.delete, deleteTotal
 	default:
-		t.counters[mongoExport].skipped.Incr(1)
+		counter.skipped.Incr(1)
+		skippedTotal.Inc(db, name, op.export)
+		return nil
+	}
+	start := time.Now()
+	err := write(op.data, coll, data)
+	writeDuration.Since(start, op.export)
+	if err != nil {
+		return err
+	}
+	rate.Incr(1)
+	total.Inc(db, name, op.export)
+	return nil
+}
+
+// flushExporters writes out anything the exporters hold in memory,
+// returning the first error
+func (t *Tailer) flushExporters() error {
+	var firstErr error
+	for name, exporter := range t.exporters {
+		if err := exporter.Flush(); err != nil {
+			log.WithFields(log.Fields{"export": name, "error": err}).Error("Unable to flush exporter")
+			if firstErr == nil {
+				firstErr = fmt.Errorf("flushing %s: %s", name, err)
+			}
+		}
+	}
+	if firstErr != nil && !t.env.skipError {
+		t.fail(firstErr)
+	}
+	return firstErr
+}
+
+// closeOutputs closes the exporters then the dead letters once,
+// both Shutdown and Serve close them
+func (t *Tailer) closeOutputs() {
+	t.closeOnce.Do(func() {
+		t.closeExporters()
+		t.closeDeadLetters()
+	})
+}
+
+// closeExporters flushes and closes every exporter in use by the Tailer
+func (t *Tailer) closeExporters() {
+	for name, exporter := range t.exporters {
+		if err := exporter.Flush(); err != nil {
+			log.WithFields(log.Fields{"export": name, "error": err}).Error("Unable to flush exporter")
+		}
+		if err := exporter.Close(); err != nil {
+			log.WithFields(log.Fields{"export": name, "error": err}).Error("Unable to close exporter")
+		}
 	}
 }
 
-func (t *Tailer) logFn(e error, workerType string, payload map[string]interface{}) {
+// logFn logs the error of an op, returning it unless -skip-error is set
+func (t *Tailer) logFn(e error, workerType string, payload map[string]interface{}) error {
 	if e != nil {
 		ts1, ts2 := gtm.ParseTimestamp(payload["timestamp"].(primitive.Timestamp))
 		gtmLag := t.MsLag(ts1, time.Now)
@@ -176,7 +332,8 @@ func (t *Tailer) logFn(e error, workerType string, payload map[string]interface{
 			"error":   e,
 		}).Error(fmt.Sprintf("%s worker processed", workerType))
 		if !t.env.skipError {
-			os.Exit(1)
+			return e
 		}
 	}
+	return nil
 }
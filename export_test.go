@@ -0,0 +1,134 @@
+package moresql
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Unexported helpers exposed to the tests of moresql_test
+
+var ColumnTypeChanges = columnTypeChanges
+var MissingMetadataColumns = missingMetadataColumns
+var CreateColumn = (*TableColumn).createColumn
+var UniqueIndex = (*TableColumn).uniqueIndex
+var CreateSchema = (*TableColumn).createSchema
+var IsInvalidate = isInvalidate
+
+var RangeBounds = rangeBounds
+var SameIDType = sameIDType
+
+// PartitionFilter is the filter of a partition
+// of bounds resumed after the _id after
+func PartitionFilter(bounds bson.D, after *bson.RawValue, query bson.D) bson.D {
+	return partition{bounds: bounds, after: after}.filter(query)
+}
+
+type Partition = partition
+
+// NewPartition is the partition index of total of db.name
+func NewPartition(db string, name string, index int, total int, bounds bson.D, after *bson.RawValue, read int64) Partition {
+	return partition{db: db, name: name, index: index, total: total, bounds: bounds, after: after, read: read}
+}
+
+var PartitionFilterOf = partition.filter
+var ProgressRow = progressRow
+var ProgressPartitions = progressPartitions
+var DecodeID = decodeID
+
+// Metrics only written by the tests of WriteMetrics
+var (
+	testCounter   = newCounterVec("moresql_test_total", "Test counter", "db", "collection")
+	testHistogram = newHistogramVec("moresql_test_seconds", "Test histogram", []float64{0.5, 1}, "export")
+)
+
+// ObserveTestMetrics sets the values of the test metrics
+func ObserveTestMetrics() {
+	testCounter.Inc("db", "a\"b\\c\n")
+	for _, v := range []float64{0.25, 0.75, 3} {
+		testHistogram.Observe(v, "pg")
+	}
+}
+
+// Readiness is the /readyz status and checks of a serving Tailer whose
+// last op was at lastOp with lagMs, and whose last checkpoint save
+// failed with checkpointErr unless empty
+func Readiness(env Env, now time.Time, lastOp *time.Time, lagMs int64, checkpointErr string) (string, map[string]string) {
+	report := healthReport{Serving: true, LastOp: lastOp, LagMs: lagMs, Checkpoint: &checkpointSave{At: now, Err: checkpointErr}}
+	report = checkReadiness(report, env, now)
+	return report.Status, report.Checks
+}
+
+var SplitFanKey = splitFanKey
+
+type FanGate = fanGate
+
+var NewFanGate = newFanGate
+
+// NewOp is an op of the document id
+func NewOp(id interface{}) Op {
+	return Op{data: &gtm.Op{Id: id}}
+}
+
+// ID is the _id of the document of op
+func (op Op) ID() interface{} {
+	return op.data.Id
+}
+
+func (g *fanGate) Hold(op Op) bool { return g.hold(op) }
+func (g *fanGate) Release() []Op   { return g.release() }
+func (g *fanGate) Retire() []Op    { return g.retire() }
+func (g *fanGate) Full() bool      { return g.full() }
+func (g *fanGate) State() (bool, int) {
+	return g.state()
+}
+
+// RecordRead is the read position of Read once it dispatched ops
+func RecordRead(ops ...*gtm.Op) (primitive.Timestamp, map[string]interface{}) {
+	var r readPosition
+	for _, op := range ops {
+		r.record(op)
+	}
+	return r.ts, r.tokens
+}
+
+// NewIdleTailer is a Tailer that was never served
+func NewIdleTailer() *Tailer {
+	return &Tailer{stop: make(chan bool), quit: make(chan struct{}), failed: make(chan struct{})}
+}
+
+// HoldInflight leaves an op in flight that is never written
+func (t *Tailer) HoldInflight() {
+	t.inflight.Add(1)
+}
+
+func (t *Tailer) WaitInflight() bool {
+	return t.waitInflight()
+}
+
+// Resnapshot runs the resnapshot of -on-stream-invalidate for a Tailer
+// of config exporting to the csv file csvPath, without postgres
+func Resnapshot(config Config, csvPath string) error {
+	env := Env{exports: csvExport, csvPathFile: csvPath, appName: "test", onStreamInvalidate: streamPolicyResnapshot, fullSyncParallelism: 1}
+	t := &Tailer{config: config, env: env, ctx: context.Background()}
+	return t.resnapshot()
+}
+
+// SetLimit sets the most pending ops before the tracker is full
+func (c *CheckpointTracker) SetLimit(limit int) {
+	c.limit = limit
+}
+
+// ReadCheckpointFrom runs Read for a Tailer with -checkpoint
+// saved in pg, and returns the error it failed with
+func ReadCheckpointFrom(pg *sqlx.DB) error {
+	env := Env{checkpoint: true, exports: postgresExport, appName: "test"}
+	t := &Tailer{pg: pg, env: env, ctx: context.Background(), stop: make(chan bool), quit: make(chan struct{}), failed: make(chan struct{}), readDone: make(chan struct{}), stopWrites: func() {}}
+	t.Read()
+	<-t.readDone
+	return t.Err()
+}
@@ -0,0 +1,105 @@
+package moresql
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Exporter is implemented by every sink that operations
+// can be streamed into. The Tailer sanitizes each op before
+// handing it over, so implementations only deal with writing.
+type Exporter interface {
+	Insert(op *gtm.Op, coll Collection, data map[string]interface{}) error
+	Update(op *gtm.Op, coll Collection, data map[string]interface{}) error
+	Delete(op *gtm.Op, coll Collection, data map[string]interface{}) error
+	// Flush persists anything the exporter holds in memory
+	Flush() error
+	// Close releases the resources held by the exporter
+	Close() error
+}
+
+// ExporterOptions carries the shared connections and settings
+// that an ExporterFactory may use to build its Exporter
+type ExporterOptions struct {
+	Config   Config
+	Postgres *sqlx.DB
+	Mongo    *mongo.Client
+	Env      Env
+	// DeadLetters is set when failed ops are kept, exporters that
+	// defer writes store the ops of a failed flush in it
+	DeadLetters DeadLetterStore
+	// Retry is the policy for writes failing with a transient error
+	Retry RetryPolicy
+	// Context stops retrying once done, writes retry until
+	// the policy gives up when it is nil
+	Context context.Context
+}
+
+// context is o.Context, or the background context when unset
+func (o ExporterOptions) context() context.Context {
+	if o.Context == nil {
+		return context.Background()
+	}
+	return o.Context
+}
+
+// ExporterFactory builds an Exporter for the value given in -exports
+type ExporterFactory func(o ExporterOptions) (Exporter, error)
+
+var (
+	exportersMu sync.RWMutex
+	exporters   = map[string]ExporterFactory{
+		postgresExport: newPostgresExporter,
+		csvExport:      newCSVExporter,
+		mongoExport:    newMongoExporter,
+	}
+)
+
+// RegisterExporter makes an Exporter available under name for -exports.
+// It is meant to be called from a wrapper main before Run and panics
+// when the name is already taken, mirroring database/sql.Register.
+func RegisterExporter(name string, factory ExporterFactory) {
+	exportersMu.Lock()
+	defer exportersMu.Unlock()
+	if factory == nil {
+		panic("moresql: RegisterExporter factory is nil")
+	}
+	if _, dup := exporters[name]; dup {
+		panic("moresql: RegisterExporter called twice for " + name)
+	}
+	exporters[name] = factory
+}
+
+// Exporters returns the sorted names of all registered exporters
+func Exporters() []string {
+	exportersMu.RLock()
+	defer exportersMu.RUnlock()
+	names := []string{}
+	for name := range exporters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupExporter(name string) (ExporterFactory, bool) {
+	exportersMu.RLock()
+	defer exportersMu.RUnlock()
+	factory, ok := exporters[name]
+	return factory, ok
+}
+
+// NewExporter resolves name against the registry and builds its Exporter
+func NewExporter(name string, o ExporterOptions) (Exporter, error) {
+	factory, ok := lookupExporter(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown export %q, registered: %v", name, Exporters())
+	}
+	return factory(o)
+}
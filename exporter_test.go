@@ -0,0 +1,47 @@
+package moresql_test
+
+import (
+	"github.com/rwynn/gtm"
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+)
+
+type nullExporter struct{}
+
+func (n nullExporter) Insert(op *gtm.Op, coll m.Collection, data map[string]interface{}) error {
+	return nil
+}
+func (n nullExporter) Update(op *gtm.Op, coll m.Collection, data map[string]interface{}) error {
+	return nil
+}
+func (n nullExporter) Delete(op *gtm.Op, coll m.Collection, data map[string]interface{}) error {
+	return nil
+}
+func (n nullExporter) Flush() error { return nil }
+func (n nullExporter) Close() error { return nil }
+
+func (s *MySuite) TestRegisterExporter(c *C) {
+	c.Check(m.EnsureRightExport([]string{"postgres", "null"}), Equals, false)
+	m.RegisterExporter("null", func(o m.ExporterOptions) (m.Exporter, error) {
+		return nullExporter{}, nil
+	})
+	c.Check(m.EnsureRightExport([]string{"postgres", "null"}), Equals, true)
+	c.Check(m.Exporters(), DeepEquals, []string{"csv", "mongo", "null", "postgres"})
+
+	e, err := m.NewExporter("null", m.ExporterOptions{})
+	c.Check(err, IsNil)
+	c.Check(e, Equals, nullExporter{})
+
+	c.Check(func() {
+		m.RegisterExporter("null", func(o m.ExporterOptions) (m.Exporter, error) { return nil, nil })
+	}, PanicMatches, ".*called twice for null")
+}
+
+func (s *MySuite) TestNewExporterErrors(c *C) {
+	_, err := m.NewExporter("kinesis", m.ExporterOptions{})
+	c.Check(err, ErrorMatches, `unknown export "kinesis".*`)
+	_, err = m.NewExporter("postgres", m.ExporterOptions{})
+	c.Check(err, ErrorMatches, ".*requires POSTGRES_URL")
+	_, err = m.NewExporter("csv", m.ExporterOptions{})
+	c.Check(err, ErrorMatches, ".*requires -csv-path-file")
+}
@@ -1,9 +1,13 @@
 package moresql
 
 import (
+	"context"
+	"encoding/json"
 	"expvar"
 	"fmt"
-	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -28,61 +32,141 @@ type FullSyncer struct {
 	MongoExportClient *mongo.Client
 	C                 chan DBResult
 	done              chan bool
+	// exporters receive every document read, keyed by their -exports name
+	exporters map[string]Exporter
+	// only limits the sync to these db.collection namespaces when set
+	only map[string]bool
+	// filters holds the mongo query used to read a db.collection
+	filters map[string]bson.D
+	// parallelism is the number of partitions read at once
+	// and partitionCount the number each collection is split into
+	parallelism    int
+	partitionCount int
+	// progress saves how far each partition was
+	// committed, nil when it can't be persisted
+	progress *syncProgress
+	// failed is set when a partition couldn't be read to its end
+	failed int32
+	// wg waits for the reader and the writers
+	wg sync.WaitGroup
+	// ctx is done once the full sync is cancelled or fails with err
+	ctx    context.Context
+	cancel context.CancelFunc
+	errMu  sync.Mutex
+	err    error
+	// stopWrites cancels the retries of the exporters once ctx is done
+	stopWrites context.CancelFunc
 
 	insertCounter *ratecounter.RateCounter
 	readCounter   *ratecounter.RateCounter
 }
 
+// Read splits each selected collection into _id range partitions
+// and reads them with -full-sync-parallelism cursors at a time.
+// Collections left by a previous full sync continue from its progress.
 func (z *FullSyncer) Read() {
+	parts := []partition{}
 	for dbName, v := range z.Config {
-		db := z.Mongo.Database(dbName)
 		for name := range v.Collections {
-			coll := db.Collection(name)
-			cur, err := coll.Find(nil, bson.D{})
-			if err != nil {
-				log.Error("Unable to find anyone in iterator: %s", err)
-			}
-			var result map[string]interface{}
-			for cur.Next(nil) {
-				z.readCounter.Incr(1)
-				cur.Decode(&result)
-				z.C <- DBResult{dbName, name, result}
-				// Clear out result data for next round
-				result = make(map[string]interface{})
-			}
-			if err := cur.Close(nil); err != nil {
-				log.Error("Unable to close iterator: %s", err)
+			ns := dbName + "." + name
+			if len(z.only) > 0 && !z.only[ns] {
+				continue
 			}
+			parts = append(parts, z.collectionPartitions(dbName, name)...)
 		}
 	}
+	z.readPartitions(parts, z.parallelism)
 	close(z.C)
-	wg.Done()
+	z.wg.Done()
+}
+
+func (z *FullSyncer) collectionPartitions(dbName string, name string) []partition {
+	ns := dbName + "." + name
+	if z.progress != nil {
+		saved, complete, err := z.progress.Load(dbName, name)
+		switch {
+		case err != nil:
+			log.WithFields(log.Fields{"collection": ns, "error": err}).Warn("Unable to load full sync progress, reading it again")
+		case complete:
+			log.WithField("collection", ns).Info("Skipping collection completed by a previous full sync")
+			return nil
+		case len(saved) > 0:
+			log.WithFields(log.Fields{"collection": ns, "partitions": len(saved)}).Info("Resuming full sync of collection")
+			return saved
+		}
+	}
+	split, err := z.partitions(dbName, name, z.partitionCount)
+	if err != nil {
+		log.WithFields(log.Fields{"collection": ns, "error": err}).Warn("Unable to partition collection, reading it whole")
+		split = []partition{{db: dbName, name: name, index: 1, total: 1}}
+	}
+	if z.progress != nil {
+		if err := z.progress.Clear(ns); err == nil {
+			err = z.progress.Start(split)
+		}
+		if err != nil {
+			log.WithFields(log.Fields{"collection": ns, "error": err}).Warn("Unable to save full sync progress")
+		}
+	}
+	return split
+}
+
+// readFailed keeps the progress for the next full sync
+func (z *FullSyncer) readFailed() {
+	atomic.StoreInt32(&z.failed, 1)
+}
+
+// fail stops the full sync on err, the reads are cancelled and the
+// documents still sent to the writers are dropped without saving
+// the progress of their partitions
+func (z *FullSyncer) fail(err error) {
+	z.errMu.Lock()
+	defer z.errMu.Unlock()
+	if z.err == nil {
+		z.err = err
+		z.readFailed()
+		z.cancel()
+	}
+}
+
+// Err is the error that stopped the full sync
+func (z *FullSyncer) Err() error {
+	z.errMu.Lock()
+	defer z.errMu.Unlock()
+	return z.err
 }
 
 func (z *FullSyncer) Write() {
 	var workers [workerCountOverflow]int
 	tables := z.buildTables()
 	for _ = range workers {
-		wg.Add(1)
+		z.wg.Add(1)
 		go z.writer(&tables)
 	}
-	wg.Done()
+	z.wg.Done()
 }
 
 func BuildOpFromMgo(mongoFields []string, e DBResult, coll Collection) (*gtm.Op, error) {
+	opRef := opFromMgo(mongoFields, e)
+	data, err := SanitizeData(coll, opRef, len(coll.ExtraProps) > 0, false)
+	if err != nil {
+		return nil, err
+	}
+	opRef.Data = data
+	return opRef, nil
+}
+
+// opFromMgo wraps a document read by full sync in an insert op
+func opFromMgo(mongoFields []string, e DBResult) *gtm.Op {
 	var op gtm.Op
 	op.Data = e.Data
 	opRef := EnsureOpHasAllFields(&op, mongoFields)
 	opRef.Id = e.Data["_id"]
+	opRef.Namespace = e.MongoDB + "." + e.Collection
 	// Set to I so we are consistent about these beings inserts
 	// This avoids our guardclause in sanitize
 	opRef.Operation = "i"
-	data, err := SanitizeData(coll, opRef, len(coll.ExtraProps) > 0, false)
-	if err != nil {
-		return nil, err
-	}
-	opRef.Data = data
-	return opRef, nil
+	return opRef
 }
 
 func (z *FullSyncer) writer(tables *cmap.ConcurrentMap) {
@@ -93,46 +177,87 @@ ForStatement:
 			if !more {
 				break ForStatement
 			}
-			key := createFanKey(e.MongoDB, e.Collection, postgresExport)
-			v, ok := tables.Get(key)
-			if ok && !v.(bool) {
-				// Table doesn't exist, skip
-				break
+			if z.Err() == nil {
+				z.write(tables, e)
 			}
-			o, coll := z.statementFromDbCollection(e.MongoDB, e.Collection)
-			op, err := BuildOpFromMgo(o.mongoFields(), e, coll)
-			if (op.Data == nil) {
-				// Data doesn't exist, skip
-				break
+			if e.pending != nil {
+				e.pending.Done()
 			}
-			if err != nil {
-				log.WithFields(log.Fields{"description": err, "data": e.Data}).Error("Error BuildOpFromMgo")
-				os.Exit(1)
-			}
-			s := o.BuildUpsert()
+		}
+	}
+	z.wg.Done()
+}
+
+// write sanitizes the document for each export the same way
+// the Tailer does and inserts it, which exporters do as an upsert
+func (z *FullSyncer) write(tables *cmap.ConcurrentMap, e DBResult) {
+	o, coll := z.statementFromDbCollection(e.MongoDB, e.Collection)
+	op := opFromMgo(o.mongoFields(), e)
+	for export, exporter := range z.exporters {
+		key := createFanKey(e.MongoDB, e.Collection, export)
+		v, ok := tables.Get(key)
+		if ok && !v.(bool) {
+			// Table doesn't exist, skip
+			continue
+		}
+		data, err := SanitizeData(coll, op, len(coll.ExtraProps) > 0, export == mongoExport)
+		if err != nil {
+			log.WithFields(log.Fields{"description": err, "data": e.Data}).Error("Error SanitizeData")
+			z.fail(fmt.Errorf("sanitizing %v of %s.%s: %s", op.Id, e.MongoDB, e.Collection, err))
+			return
+		}
+		if data == nil {
+			// Data doesn't exist, skip
+			skippedTotal.Inc(e.MongoDB, e.Collection, export)
+			continue
+		}
+		log.WithFields(log.Fields{
+			"collection": e.Collection,
+			"export":     export,
+			"id":         op.Id,
+		}).Info("Syncing record")
+		log.Debug("Data ", data)
+		start := time.Now()
+		err = exporter.Insert(op, coll, data)
+		writeDuration.Since(start, export)
+		if err != nil {
+			errorsTotal.Inc(e.MongoDB, e.Collection, export)
 			log.WithFields(log.Fields{
-				"collection": e.Collection,
-				"id":         op.Id,
-			}).Info("Syncing record")
-			log.Debug("SQL Command ", s)
-			log.Debug("Data ", op.Data)
-			log.Debug("Executing statement: ", s)
-			_, err = z.Output.NamedExec(s, op.Data)
-			log.Debug("Statement executed successfully")
-			z.insertCounter.Incr(1)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"description": err,
-				}).Error("Error")
-				if err.Error() == fmt.Sprintf(`pq: relation "%s" does not exist`, e.Collection) {
-					tables.Set(key, false)
-				}
-				os.Exit(1)
+				"description": err,
+				"export":      export,
+			}).Error("Error")
+			if err.Error() == fmt.Sprintf(`pq: relation "%s" does not exist`, e.Collection) {
+				tables.Set(key, false)
 			}
+			z.fail(fmt.Errorf("writing %v of %s.%s to %s: %s", op.Id, e.MongoDB, e.Collection, export, err))
+			return
 		}
+		z.insertCounter.Incr(1)
+		insertTotal.Inc(e.MongoDB, e.Collection, export)
 	}
-	wg.Done()
 }
+
+// flushExporters writes out the documents batched by the exporters
+func (z *FullSyncer) flushExporters() {
+	for export, exporter := range z.exporters {
+		if err := exporter.Flush(); err != nil {
+			log.WithFields(log.Fields{
+				"description": err,
+				"export":      export,
+			}).Error("Error")
+			z.fail(fmt.Errorf("flushing %s: %s", export, err))
+		}
+	}
+}
+
+func (z *FullSyncer) closeExporters() {
+	for export, exporter := range z.exporters {
+		if err := exporter.Close(); err != nil {
+			log.WithFields(log.Fields{"export": export, "error": err}).Error("Unable to close exporter")
+		}
+	}
+}
+
 func (z *FullSyncer) statementFromDbCollection(db string, collectionName string) (Statement, Collection) {
 	c := z.Config[db].Collections[collectionName]
 	return Statement{c}, c
@@ -142,31 +267,176 @@ func (z *FullSyncer) buildTables() (tables cmap.ConcurrentMap) {
 	tables = cmap.New()
 	for dbName, db := range z.Config {
 		for collectionName := range db.Collections {
-			// Assume all tables are present
-			tables.Set(createFanKey(dbName, collectionName, postgresExport), true)
+			for export := range z.exporters {
+				// Assume all tables are present
+				tables.Set(createFanKey(dbName, collectionName, export), true)
+			}
 		}
 	}
 	return
 }
 
-func NewSynchronizer(config Config, pg *sqlx.DB, mongo *mongo.Client, mongoExportClient *mongo.Client) FullSyncer {
+// Select restricts the sync to the comma separated db.collection
+// namespaces of only, and reads each namespace of filters, a json object
+// of namespace to extended json query, with its query instead of
+// reading the whole collection. Empty values keep the full sync.
+func (z *FullSyncer) Select(only string, filters string) error {
+	z.only = make(map[string]bool)
+	for _, ns := range strings.Split(only, ",") {
+		ns = strings.TrimSpace(ns)
+		if len(ns) == 0 {
+			continue
+		}
+		if !z.hasNamespace(ns) {
+			return fmt.Errorf("%s is not a db.collection of the config", ns)
+		}
+		z.only[ns] = true
+	}
+	parsed, err := ParseFullSyncFilters(filters)
+	if err != nil {
+		return err
+	}
+	for ns := range parsed {
+		if !z.hasNamespace(ns) {
+			return fmt.Errorf("filter for %s, which is not a db.collection of the config", ns)
+		}
+	}
+	z.filters = parsed
+	return nil
+}
+
+func (z *FullSyncer) hasNamespace(ns string) bool {
+	parts := strings.SplitN(ns, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	_, ok := z.Config[parts[0]].Collections[parts[1]]
+	return ok
+}
+
+// ParseFullSyncFilters parses -full-sync-filter, ie
+// {"db.coll": {"updated_at": {"$gte": {"$date": "2020-01-01T00:00:00Z"}}}}
+func ParseFullSyncFilters(s string) (map[string]bson.D, error) {
+	filters := make(map[string]bson.D)
+	if len(strings.TrimSpace(s)) == 0 {
+		return filters, nil
+	}
+	raw := make(map[string]json.RawMessage)
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		return nil, err
+	}
+	for ns, query := range raw {
+		var filter bson.D
+		if err := bson.UnmarshalExtJSON(query, false, &filter); err != nil {
+			return nil, fmt.Errorf("filter for %s: %s", ns, err)
+		}
+		filters[ns] = filter
+	}
+	return filters, nil
+}
+
+// NewSynchronizer builds the full sync of o: the collections selected by
+// -full-sync-only and -full-sync-filter, written to each of -exports
+func NewSynchronizer(o Options) (*FullSyncer, error) {
+	env := o.Env
 	c := make(chan DBResult)
 	insertCounter := ratecounter.NewRateCounter(1 * time.Second)
 	readCounter := ratecounter.NewRateCounter(1 * time.Second)
-	expvar.Publish("insert/sec", insertCounter)
-	expvar.Publish("read/sec", readCounter)
+	// A resnapshot from the tailer runs more than one full sync
+	if expvar.Get("insert/sec") == nil {
+		expvar.Publish("insert/sec", insertCounter)
+		expvar.Publish("read/sec", readCounter)
+	}
 	done := make(chan bool, 2)
-	sync := FullSyncer{config, pg, mongo, mongoExportClient, c, done, insertCounter, readCounter}
-	return sync
+	sync := &FullSyncer{Config: o.Config, Output: o.Postgres, Mongo: o.Mongo, MongoExportClient: o.MongoExport, C: c, done: done, insertCounter: insertCounter, readCounter: readCounter}
+	if err := sync.Select(env.fullSyncOnly, env.fullSyncFilter); err != nil {
+		return nil, fmt.Errorf("invalid full sync selection: %s", err)
+	}
+	sync.parallelism = env.fullSyncParallelism
+	sync.partitionCount = env.fullSyncPartitions
+	if sync.partitionCount == 0 {
+		sync.partitionCount = sync.parallelism
+	}
+	// Every document is written as an upsert so that documents
+	// read again by a resumed full sync don't conflict
+	env.justInsert = false
+	writes, stopWrites := context.WithCancel(context.Background())
+	sync.stopWrites = stopWrites
+	eo := ExporterOptions{Config: o.Config, Postgres: o.Postgres, Mongo: o.MongoExport, Env: env, Retry: NewRetryPolicy(env), Context: writes}
+	sync.exporters = make(map[string]Exporter)
+	for _, export := range strings.Split(env.exports, ",") {
+		exporter, err := NewExporter(export, eo)
+		if err != nil {
+			stopWrites()
+			sync.closeExporters()
+			return nil, fmt.Errorf("building exporter %s: %s", export, err)
+		}
+		sync.exporters[export] = exporter
+	}
+	if o.Postgres != nil {
+		progress, err := newSyncProgress(o.Postgres, env.appName)
+		if err != nil {
+			log.WithField("error", err).Warn("Unable to create moresql_sync_progress, full sync won't be resumable")
+		} else {
+			sync.progress = progress
+		}
+	}
+	return sync, nil
+}
+
+// FullSync copies every selected collection of o to its exports
+func FullSync(ctx context.Context, o Options) error {
+	sync, err := NewSynchronizer(o)
+	if err != nil {
+		return err
+	}
+	return sync.Sync(ctx)
 }
 
-func FullSync(config Config, pg *sqlx.DB, mongo *mongo.Client, mongoExportClient *mongo.Client) {
-	sync := NewSynchronizer(config, pg, mongo, mongoExportClient)
-	wg.Add(2)
+// Sync reads the selected collections and writes them to the exporters,
+// which it closes once done. When ctx is done or a write fails the
+// progress of the collections is kept for the next full sync.
+func (z *FullSyncer) Sync(ctx context.Context) error {
+	z.ctx, z.cancel = context.WithCancel(ctx)
+	defer z.cancel()
+	defer z.closeExporters()
+	go func() {
+		<-z.ctx.Done()
+		z.stopWrites()
+	}()
+	z.wg.Add(2)
 	log.Debug("Starting writer")
-	go sync.Write()
+	go z.Write()
 	log.Debug("Starting reader")
-	go sync.Read()
+	go z.Read()
 
-	wg.Wait()
+	z.wg.Wait()
+	if z.Err() == nil {
+		z.flushExporters()
+	}
+	if err := z.Err(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if atomic.LoadInt32(&z.failed) != 0 {
+		return fmt.Errorf("full sync did not read every partition, rerun -full-sync to continue it")
+	}
+	if z.progress == nil {
+		return nil
+	}
+	// Every collection is done, the next full sync starts over
+	namespaces := []string{}
+	for dbName, db := range z.Config {
+		for name := range db.Collections {
+			if ns := dbName + "." + name; len(z.only) == 0 || z.only[ns] {
+				namespaces = append(namespaces, ns)
+			}
+		}
+	}
+	if err := z.progress.Clear(namespaces...); err != nil {
+		log.WithField("error", err).Warn("Unable to clear full sync progress")
+	}
+	return nil
 }
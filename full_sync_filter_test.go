@@ -0,0 +1,28 @@
+package moresql_test
+
+import (
+	m "github.com/zph/moresql"
+	"go.mongodb.org/mongo-driver/bson"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestParseFullSyncFilters(c *C) {
+	filters, err := m.ParseFullSyncFilters(`{"db.users": {"updated_at": {"$gte": {"$numberInt": "5"}}}}`)
+	c.Assert(err, IsNil)
+	c.Check(filters["db.users"], DeepEquals, bson.D{{Key: "updated_at", Value: bson.D{{Key: "$gte", Value: int32(5)}}}})
+
+	filters, err = m.ParseFullSyncFilters("")
+	c.Assert(err, IsNil)
+	c.Check(filters, HasLen, 0)
+
+	_, err = m.ParseFullSyncFilters(`{"db.users": "updated_at"}`)
+	c.Check(err, NotNil)
+}
+
+func (s *MySuite) TestFullSyncerSelect(c *C) {
+	config := m.Config{"db": m.DB{Collections: m.Collections{"users": m.Collection{Name: "users"}, "orders": m.Collection{Name: "orders"}}}}
+	z := m.FullSyncer{Config: config}
+	c.Check(z.Select("db.users, db.orders", `{"db.users": {}}`), IsNil)
+	c.Check(z.Select("db.missing", ""), ErrorMatches, "db.missing is not a db.collection of the config")
+	c.Check(z.Select("", `{"other.users": {}}`), ErrorMatches, "filter for other.users, .*")
+}
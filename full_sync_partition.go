@@ -0,0 +1,310 @@
+package moresql
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// minPartitionSize is the smallest estimated number of
+	// documents worth a partition of its own
+	minPartitionSize = 10000
+
+	// partitionSamples is the number of _ids sampled
+	// per partition to pick the range boundaries
+	partitionSamples = 20
+
+	// partitionProgress is how many documents a partition
+	// reads between progress reports
+	partitionProgress = 50000
+
+	// partitionCheckpoint is how many documents a partition
+	// reads between saves of its progress
+	partitionCheckpoint = 10000
+)
+
+// partition is a range of _id of a collection read by a single cursor
+// sorted by _id. Range queries don't cross bson types so when the
+// collection holds _ids of another type than the sampled ones, those
+// are read by a partition of their own.
+type partition struct {
+	db     string
+	name   string
+	index  int
+	total  int
+	bounds bson.D
+	// after is the last _id written by a previous run
+	after *bson.RawValue
+	// read counts the documents written by this and previous runs
+	read int64
+}
+
+func (p partition) ns() string {
+	return p.db + "." + p.name
+}
+
+func typeBounds(idType bsontype.Type) bson.D {
+	return bson.D{{Key: "_id", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$type", Value: int(idType)}}}}}}
+}
+
+// sameIDType reports whether range queries on _ids of type a
+// also match type b, numbers compare across their types
+func sameIDType(a bsontype.Type, b bsontype.Type) bool {
+	numeric := func(t bsontype.Type) bool {
+		return t == bsontype.Int32 || t == bsontype.Int64 || t == bsontype.Double || t == bsontype.Decimal128
+	}
+	return a == b || numeric(a) && numeric(b)
+}
+
+func rangeBounds(lower *bson.RawValue, upper *bson.RawValue) bson.D {
+	bounds := bson.D{}
+	if lower != nil {
+		bounds = append(bounds, bson.E{Key: "$gte", Value: *lower})
+	}
+	if upper != nil {
+		bounds = append(bounds, bson.E{Key: "$lt", Value: *upper})
+	}
+	return bson.D{{Key: "_id", Value: bounds}}
+}
+
+// resumeFilter selects the _ids sorted after p.after. As $gt only
+// matches the type of p.after, _ids of other types are read again,
+// which is harmless as full sync upserts.
+func (p partition) resumeFilter() bson.D {
+	if p.after == nil {
+		return nil
+	}
+	return bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: *p.after}}}},
+		typeBounds(p.after.Type),
+	}}}
+}
+
+// filter combines the partition's range and resume position
+// with the -full-sync-filter query
+func (p partition) filter(query bson.D) bson.D {
+	clauses := bson.A{}
+	for _, clause := range []bson.D{query, p.bounds, p.resumeFilter()} {
+		if len(clause) > 0 {
+			clauses = append(clauses, clause)
+		}
+	}
+	switch len(clauses) {
+	case 0:
+		return bson.D{}
+	case 1:
+		return clauses[0].(bson.D)
+	}
+	return bson.D{{Key: "$and", Value: clauses}}
+}
+
+// partitions splits a collection into up to n ranges of _id using the
+// sorted _ids of a $sample. A collection too small to split, or whose
+// sample mixes _id types, is read as a single partition.
+func (z *FullSyncer) partitions(dbName string, name string, n int) ([]partition, error) {
+	whole := []partition{{db: dbName, name: name, index: 1, total: 1}}
+	if n <= 1 {
+		return whole, nil
+	}
+	coll := z.Mongo.Database(dbName).Collection(name)
+	count, err := coll.EstimatedDocumentCount(z.ctx)
+	if err != nil {
+		return nil, err
+	}
+	if limit := int(count / minPartitionSize); limit < n {
+		n = limit
+	}
+	if n <= 1 {
+		return whole, nil
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$sample", Value: bson.D{{Key: "size", Value: n * partitionSamples}}}},
+		{{Key: "$project", Value: bson.D{{Key: "_id", Value: 1}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+	}
+	cur, err := coll.Aggregate(z.ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(context.Background())
+	ids := []bson.RawValue{}
+	for cur.Next(z.ctx) {
+		id := cur.Current.Lookup("_id")
+		if len(ids) > 0 && id.Type != ids[0].Type {
+			return whole, nil
+		}
+		ids = append(ids, id)
+	}
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) < n {
+		return whole, nil
+	}
+
+	bounds := []bson.RawValue{}
+	for i := 1; i < n; i++ {
+		id := ids[i*len(ids)/n]
+		if len(bounds) > 0 && id.Equal(bounds[len(bounds)-1]) {
+			continue
+		}
+		bounds = append(bounds, id)
+	}
+	parts := []partition{}
+	for i := 0; i <= len(bounds); i++ {
+		var lower, upper *bson.RawValue
+		if i > 0 {
+			lower = &bounds[i-1]
+		}
+		if i < len(bounds) {
+			upper = &bounds[i]
+		}
+		parts = append(parts, partition{db: dbName, name: name, bounds: rangeBounds(lower, upper)})
+	}
+	single, err := z.singleIDType(coll, ids[0].Type)
+	if err != nil {
+		return nil, err
+	}
+	if !single {
+		// Without a range to use the _id index this partition
+		// scans the collection, it is only read when needed
+		parts = append(parts, partition{db: dbName, name: name, bounds: typeBounds(ids[0].Type)})
+	}
+	for i := range parts {
+		parts[i].index = i + 1
+		parts[i].total = len(parts)
+	}
+	return parts, nil
+}
+
+// singleIDType reports whether every _id of coll has the type idType.
+// _ids sort by type first, so it is enough that the smallest and the
+// largest _id have that type.
+func (z *FullSyncer) singleIDType(coll *mongo.Collection, idType bsontype.Type) (bool, error) {
+	for _, order := range []int{1, -1} {
+		sorted := options.FindOne().SetSort(bson.D{{Key: "_id", Value: order}}).SetProjection(bson.D{{Key: "_id", Value: 1}})
+		doc, err := coll.FindOne(z.ctx, bson.D{}, sorted).DecodeBytes()
+		if err == mongo.ErrNoDocuments {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if !sameIDType(idType, doc.Lookup("_id").Type) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// readPartitions reads every partition with up to parallelism
+// cursors at a time, sending each document to the writers
+func (z *FullSyncer) readPartitions(parts []partition, parallelism int) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	queue := make(chan partition)
+	var readers sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for p := range queue {
+				z.readPartition(p)
+			}
+		}()
+	}
+	for _, p := range parts {
+		queue <- p
+	}
+	close(queue)
+	readers.Wait()
+}
+
+func (z *FullSyncer) readPartition(p partition) {
+	fields := log.Fields{"collection": p.ns(), "partition": fmt.Sprintf("%d/%d", p.index, p.total)}
+	if z.ctx.Err() != nil {
+		// Cancelled or failed, the partition is left for the next full sync
+		z.readFailed()
+		return
+	}
+	filter := p.filter(z.filters[p.ns()])
+	log.WithFields(fields).WithFields(log.Fields{"filter": filter, "resumed": p.read}).Info("Full sync of partition")
+	start := time.Now()
+	sorted := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}})
+	cur, err := z.Mongo.Database(p.db).Collection(p.name).Find(z.ctx, filter, sorted)
+	if err != nil {
+		z.readFailed()
+		log.WithFields(fields).Errorf("Unable to find anyone in iterator: %s", err)
+		return
+	}
+	// pending counts the documents sent to the writers
+	// that are not yet part of a saved checkpoint
+	var pending sync.WaitGroup
+	read := 0
+	// readErr stops the read before the document it failed on,
+	// the partition resumes from the last document read
+	var readErr error
+	for cur.Next(z.ctx) {
+		result := make(map[string]interface{})
+		if err := cur.Decode(&result); err != nil {
+			readErr = fmt.Errorf("unable to decode document: %s", err)
+			break
+		}
+		id := cur.Current.Lookup("_id")
+		z.readCounter.Incr(1)
+		for export := range z.exporters {
+			readTotal.Inc(p.db, p.name, export)
+		}
+		read++
+		p.read++
+		if read%partitionProgress == 0 {
+			log.WithFields(fields).WithField("read", read).Info("Full sync progress")
+		}
+		pending.Add(1)
+		z.C <- DBResult{MongoDB: p.db, Collection: p.name, Data: result, pending: &pending}
+		p.after = &id
+		if read%partitionCheckpoint == 0 {
+			z.checkpoint(p, &pending, syncRunning)
+		}
+	}
+	if readErr == nil {
+		readErr = cur.Err()
+	}
+	state := syncComplete
+	if readErr != nil {
+		z.readFailed()
+		log.WithFields(fields).Errorf("Iterator failed: %s", readErr)
+		state = syncRunning
+	}
+	if err := cur.Close(context.Background()); err != nil {
+		log.WithFields(fields).Errorf("Unable to close iterator: %s", err)
+	}
+	z.checkpoint(p, &pending, state)
+	log.WithFields(fields).WithFields(log.Fields{"read": read, "duration": time.Since(start).String()}).Info("Full sync of partition done")
+}
+
+// checkpoint saves p's progress once every document
+// it read has been committed by the exporters
+func (z *FullSyncer) checkpoint(p partition, pending *sync.WaitGroup, state string) {
+	pending.Wait()
+	if z.progress == nil || z.Err() != nil {
+		return
+	}
+	z.flushExporters()
+	if z.Err() != nil {
+		return
+	}
+	if err := z.progress.Save(p, state); err != nil {
+		log.WithFields(log.Fields{"collection": p.ns(), "error": err}).Warn("Unable to save full sync progress")
+	}
+}
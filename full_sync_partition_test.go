@@ -0,0 +1,49 @@
+package moresql_test
+
+import (
+	m "github.com/zph/moresql"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	. "gopkg.in/check.v1"
+)
+
+func rawID(c *C, id interface{}) *bson.RawValue {
+	doc, err := bson.Marshal(bson.D{{Key: "_id", Value: id}})
+	c.Assert(err, IsNil)
+	v := bson.Raw(doc).Lookup("_id")
+	return &v
+}
+
+func (s *MySuite) TestRangeBounds(c *C) {
+	lower, upper := rawID(c, "a"), rawID(c, "m")
+	c.Check(m.RangeBounds(lower, upper), DeepEquals, bson.D{{Key: "_id", Value: bson.D{{Key: "$gte", Value: *lower}, {Key: "$lt", Value: *upper}}}})
+	c.Check(m.RangeBounds(nil, upper), DeepEquals, bson.D{{Key: "_id", Value: bson.D{{Key: "$lt", Value: *upper}}}})
+	c.Check(m.RangeBounds(lower, nil), DeepEquals, bson.D{{Key: "_id", Value: bson.D{{Key: "$gte", Value: *lower}}}})
+	c.Check(m.RangeBounds(nil, nil), DeepEquals, bson.D{{Key: "_id", Value: bson.D{}}})
+}
+
+func (s *MySuite) TestPartitionFilter(c *C) {
+	c.Check(m.PartitionFilter(nil, nil, nil), DeepEquals, bson.D{})
+
+	query := bson.D{{Key: "active", Value: true}}
+	c.Check(m.PartitionFilter(nil, nil, query), DeepEquals, query)
+
+	bounds := m.RangeBounds(rawID(c, int32(1)), rawID(c, int32(10)))
+	c.Check(m.PartitionFilter(bounds, nil, query), DeepEquals, bson.D{{Key: "$and", Value: bson.A{query, bounds}}})
+
+	after := rawID(c, int32(5))
+	resume := bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: *after}}}},
+		bson.D{{Key: "_id", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$type", Value: int(bsontype.Int32)}}}}}},
+	}}}
+	c.Check(m.PartitionFilter(bounds, after, nil), DeepEquals, bson.D{{Key: "$and", Value: bson.A{bounds, resume}}})
+	c.Check(m.PartitionFilter(bounds, after, query), DeepEquals, bson.D{{Key: "$and", Value: bson.A{query, bounds, resume}}})
+}
+
+func (s *MySuite) TestSameIDType(c *C) {
+	c.Check(m.SameIDType(bsontype.ObjectID, bsontype.ObjectID), Equals, true)
+	c.Check(m.SameIDType(bsontype.Int32, bsontype.Double), Equals, true)
+	c.Check(m.SameIDType(bsontype.Int64, bsontype.Decimal128), Equals, true)
+	c.Check(m.SameIDType(bsontype.ObjectID, bsontype.String), Equals, false)
+	c.Check(m.SameIDType(bsontype.Int32, bsontype.String), Equals, false)
+}
@@ -0,0 +1,168 @@
+package moresql
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// States of a partition in moresql_sync_progress
+const (
+	syncRunning  = "running"
+	syncComplete = "complete"
+)
+
+// SyncProgress is a row of moresql_sync_progress. Bounds is the
+// partition's _id range and LastID the last _id committed to postgres,
+// both as canonical extended json so the bson types survive.
+type SyncProgress struct {
+	AppName   string    `db:"app_name"`
+	Namespace string    `db:"namespace"`
+	Partition int       `db:"partition"`
+	Total     int       `db:"total"`
+	Bounds    string    `db:"bounds"`
+	LastID    string    `db:"last_id"`
+	DocCount  int64     `db:"doc_count"`
+	State     string    `db:"state"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+// syncProgress persists the progress of a full sync so that a
+// restarted full sync continues where the previous one stopped
+type syncProgress struct {
+	pg      *sqlx.DB
+	appName string
+}
+
+func newSyncProgress(pg *sqlx.DB, appName string) (*syncProgress, error) {
+	q := Queries{}
+	if _, err := pg.Exec(q.CreateSyncProgressTable()); err != nil {
+		return nil, err
+	}
+	return &syncProgress{pg: pg, appName: appName}, nil
+}
+
+// Load returns the partitions of a collection left by a previous full
+// sync, positioned after their last committed _id. complete is true when
+// every partition was read, parts is empty when there is no progress.
+func (s *syncProgress) Load(dbName string, name string) (parts []partition, complete bool, err error) {
+	q := Queries{}
+	rows := []SyncProgress{}
+	if err := s.pg.Select(&rows, q.GetSyncProgress(), s.appName, dbName+"."+name); err != nil {
+		return nil, false, err
+	}
+	return progressPartitions(dbName, name, rows)
+}
+
+// progressPartitions returns the partitions of rows that are not
+// complete, complete is true when there are rows and all are complete
+func progressPartitions(dbName string, name string, rows []SyncProgress) (parts []partition, complete bool, err error) {
+	if len(rows) == 0 {
+		return nil, false, nil
+	}
+	complete = true
+	for _, row := range rows {
+		if row.State == syncComplete {
+			continue
+		}
+		complete = false
+		p := partition{db: dbName, name: name, index: row.Partition, total: row.Total, read: row.DocCount}
+		if err := bson.UnmarshalExtJSON([]byte(row.Bounds), true, &p.bounds); err != nil {
+			return nil, false, err
+		}
+		if len(row.LastID) > 0 {
+			if p.after, err = decodeID(row.LastID); err != nil {
+				return nil, false, err
+			}
+		}
+		parts = append(parts, p)
+	}
+	return parts, complete, nil
+}
+
+// Start records the partitions a collection was split into
+// before any of them is read
+func (s *syncProgress) Start(parts []partition) error {
+	for _, p := range parts {
+		if err := s.Save(p, syncRunning); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *syncProgress) Save(p partition, state string) error {
+	q := Queries{}
+	row, err := progressRow(s.appName, p, state)
+	if err != nil {
+		return err
+	}
+	_, err = s.pg.Exec(q.SaveSyncProgress(), row.AppName, row.Namespace, row.Partition, row.Total, row.Bounds, row.LastID, row.DocCount, row.State)
+	return err
+}
+
+// progressRow is the row saving p in state
+func progressRow(appName string, p partition, state string) (SyncProgress, error) {
+	// A whole collection has no bounds, which doesn't marshal when nil
+	bounds, err := bson.MarshalExtJSON(append(bson.D{}, p.bounds...), true, false)
+	if err != nil {
+		return SyncProgress{}, err
+	}
+	lastID := ""
+	if p.after != nil {
+		b, err := bson.MarshalExtJSON(bson.D{{Key: "_id", Value: *p.after}}, true, false)
+		if err != nil {
+			return SyncProgress{}, err
+		}
+		lastID = string(b)
+	}
+	return SyncProgress{AppName: appName, Namespace: p.ns(), Partition: p.index, Total: p.total, Bounds: string(bounds), LastID: lastID, DocCount: p.read, State: state}, nil
+}
+
+// Clear forgets the progress of the namespaces, or of every
+// namespace of the app when none are given
+func (s *syncProgress) Clear(namespaces ...string) error {
+	q := Queries{}
+	if len(namespaces) == 0 {
+		_, err := s.pg.Exec(q.DeleteAllSyncProgress(), s.appName)
+		return err
+	}
+	for _, ns := range namespaces {
+		if _, err := s.pg.Exec(q.DeleteSyncProgress(), s.appName, ns); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeID reads the _id of a {"_id": ...} canonical extended json document
+func decodeID(s string) (*bson.RawValue, error) {
+	var doc bson.D
+	if err := bson.UnmarshalExtJSON([]byte(s), true, &doc); err != nil {
+		return nil, err
+	}
+	b, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	id := bson.Raw(b).Lookup("_id")
+	return &id, nil
+}
+
+// ClearFullSyncProgress makes the next full sync of appName start
+// from scratch, as needed when the tailer resnapshots. Without
+// postgres there is no progress to clear.
+func ClearFullSyncProgress(pg *sqlx.DB, appName string) {
+	if pg == nil {
+		return
+	}
+	progress, err := newSyncProgress(pg, appName)
+	if err == nil {
+		err = progress.Clear()
+	}
+	if err != nil {
+		log.WithField("error", err).Warn("Unable to clear full sync progress")
+	}
+}
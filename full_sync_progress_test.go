@@ -0,0 +1,96 @@
+package moresql_test
+
+import (
+	m "github.com/zph/moresql"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	. "gopkg.in/check.v1"
+)
+
+func marshalFilter(c *C, filter bson.D) bson.Raw {
+	b, err := bson.Marshal(filter)
+	c.Assert(err, IsNil)
+	return b
+}
+
+func (s *MySuite) TestProgressRowRoundTrip(c *C) {
+	id := primitive.NewObjectID()
+	bounds := m.RangeBounds(rawID(c, id), nil)
+	p := m.NewPartition("db", "users", 2, 3, bounds, rawID(c, id), 42)
+
+	row, err := m.ProgressRow("app", p, "running")
+	c.Assert(err, IsNil)
+	c.Check(row.AppName, Equals, "app")
+	c.Check(row.Namespace, Equals, "db.users")
+	c.Check(row.Partition, Equals, 2)
+	c.Check(row.Total, Equals, 3)
+	c.Check(row.LastID, Equals, `{"_id":{"$oid":"`+id.Hex()+`"}}`)
+	c.Check(row.DocCount, Equals, int64(42))
+
+	parts, complete, err := m.ProgressPartitions("db", "users", []m.SyncProgress{row})
+	c.Assert(err, IsNil)
+	c.Check(complete, Equals, false)
+	c.Assert(parts, HasLen, 1)
+	query := bson.D{{Key: "active", Value: true}}
+	c.Check(marshalFilter(c, m.PartitionFilterOf(parts[0], query)), DeepEquals, marshalFilter(c, m.PartitionFilterOf(p, query)))
+}
+
+func (s *MySuite) TestProgressRowWholeCollection(c *C) {
+	row, err := m.ProgressRow("app", m.NewPartition("db", "users", 1, 1, nil, nil, 0), "running")
+	c.Assert(err, IsNil)
+	c.Check(row.Bounds, Equals, "{}")
+	c.Check(row.LastID, Equals, "")
+
+	parts, _, err := m.ProgressPartitions("db", "users", []m.SyncProgress{row})
+	c.Assert(err, IsNil)
+	c.Assert(parts, HasLen, 1)
+	c.Check(m.PartitionFilterOf(parts[0], nil), DeepEquals, bson.D{})
+}
+
+func (s *MySuite) TestProgressPartitions(c *C) {
+	parts, complete, err := m.ProgressPartitions("db", "users", nil)
+	c.Assert(err, IsNil)
+	c.Check(parts, HasLen, 0)
+	c.Check(complete, Equals, false)
+
+	done := m.SyncProgress{Partition: 1, Total: 2, Bounds: "{}", State: "complete"}
+	running := m.SyncProgress{Partition: 2, Total: 2, Bounds: "{}", State: "running"}
+	parts, complete, err = m.ProgressPartitions("db", "users", []m.SyncProgress{done, running})
+	c.Assert(err, IsNil)
+	c.Check(parts, HasLen, 1)
+	c.Check(complete, Equals, false)
+
+	parts, complete, err = m.ProgressPartitions("db", "users", []m.SyncProgress{done})
+	c.Assert(err, IsNil)
+	c.Check(parts, HasLen, 0)
+	c.Check(complete, Equals, true)
+
+	running.LastID = "not json"
+	_, _, err = m.ProgressPartitions("db", "users", []m.SyncProgress{running})
+	c.Check(err, NotNil)
+}
+
+func (s *MySuite) TestDecodeID(c *C) {
+	id, err := m.DecodeID(`{"_id":{"$numberLong":"7"}}`)
+	c.Assert(err, IsNil)
+	c.Check(id.Type, Equals, bsontype.Int64)
+	c.Check(id.Int64(), Equals, int64(7))
+
+	id, err = m.DecodeID(`{"_id":"abc"}`)
+	c.Assert(err, IsNil)
+	c.Check(id.StringValue(), Equals, "abc")
+
+	_, err = m.DecodeID(`{"_id":`)
+	c.Check(err, NotNil)
+}
+
+func (s *MySuite) TestResumeFilter(c *C) {
+	after, err := m.DecodeID(`{"_id":"abc"}`)
+	c.Assert(err, IsNil)
+	p := m.NewPartition("db", "users", 1, 1, nil, after, 10)
+	c.Check(m.PartitionFilterOf(p, nil), DeepEquals, bson.D{{Key: "$or", Value: bson.A{
+		bson.D{{Key: "_id", Value: bson.D{{Key: "$gt", Value: *after}}}},
+		bson.D{{Key: "_id", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$type", Value: int(bsontype.String)}}}}}},
+	}}})
+}
@@ -2,7 +2,7 @@ package moresql_test
 
 import (
 	m "github.com/zph/moresql"
-	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	. "gopkg.in/check.v1"
 )
 
@@ -25,14 +25,14 @@ func BuildFields(sx ...string) m.Fields {
 
 func (s *MySuite) TestBuildOpFromMongo(c *C) {
 	result := make(map[string]interface{})
-	id := bson.ObjectId("123")
+	id := primitive.NewObjectID()
 	result["_id"] = id
 	result["name"] = "Alice"
 	result["age"] = "28"
 	result["job"] = "IT"
-	db := m.DBResult{"user", "user", result}
+	db := m.DBResult{MongoDB: "user", Collection: "user", Data: result}
 	fields := BuildFields("_id", "name", "age")
-	coll := m.Collection{"user", "public", fields, "JSONB", nil}
+	coll := m.Collection{Name: "user", Schema: "public", Fields: fields, ExtraProps: "JSONB"}
 	op, _ := m.BuildOpFromMgo([]string{"_id", "name", "age"}, db, coll)
 
 	c.Check(op.Id, Equals, id)
@@ -0,0 +1,200 @@
+package moresql
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// healthPingTimeout bounds each connection check of /readyz
+const healthPingTimeout = time.Duration(2) * time.Second
+
+// healthTailer is the Tailer reported on by /healthz and /readyz,
+// unset while only a full sync is running
+var healthTailer atomic.Value
+
+// activity is the last op a fan processed, kept in Tailer.activity
+type activity struct {
+	At    time.Time
+	LagMs int64
+}
+
+// checkpointSave is the outcome of the last SaveLatestCheckpoint
+type checkpointSave struct {
+	At  time.Time
+	Err string
+}
+
+type exportHealth struct {
+	RatePerMin map[string]int64 `json:"rate_per_min"`
+}
+
+type collectionHealth struct {
+	LastOp   *time.Time `json:"last_op,omitempty"`
+	LagMs    int64      `json:"lag_ms"`
+	Buffered int        `json:"buffered"`
+}
+
+type healthReport struct {
+	Status      string                      `json:"status"`
+	Serving     bool                        `json:"serving"`
+	Checks      map[string]string           `json:"checks,omitempty"`
+	LastOp      *time.Time                  `json:"last_op,omitempty"`
+	LagMs       int64                       `json:"lag_ms"`
+	Checkpoint  *checkpointSave             `json:"checkpoint,omitempty"`
+	Exports     map[string]exportHealth     `json:"exports,omitempty"`
+	Collections map[string]collectionHealth `json:"collections,omitempty"`
+}
+
+// HandleHealth adds /healthz and /readyz to the mux
+// served by -enable-monitor
+func HandleHealth(mux *http.ServeMux, env Env) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		report := healthReport{Status: "ok"}
+		if t, ok := healthTailer.Load().(*Tailer); ok {
+			report = t.details()
+			report.Status = "ok"
+			if !report.Serving {
+				report.Status = "not serving"
+			}
+		}
+		writeHealth(w, report)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		t, ok := healthTailer.Load().(*Tailer)
+		if !ok {
+			writeHealth(w, healthReport{Status: "not tailing"})
+			return
+		}
+		writeHealth(w, t.readiness(env))
+	})
+}
+
+func writeHealth(w http.ResponseWriter, report healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.WithField("error", err).Error("Unable to write health report")
+	}
+}
+
+// recordActivity keeps when the fan of op last processed an op
+func (t *Tailer) recordActivity(op Op, lagMs int64) {
+	key := createFanKey(op.data.GetDatabase(), op.data.GetCollection(), op.export)
+	t.activity.Set(key, activity{At: time.Now(), LagMs: lagMs})
+	t.activity.Set("latest", activity{At: time.Now(), LagMs: lagMs})
+}
+
+// details reports the Tailer's counters and the activity of each fan
+func (t *Tailer) details() healthReport {
+	report := healthReport{
+		Serving:     atomic.LoadInt32(&t.serving) == 1,
+		Exports:     make(map[string]exportHealth),
+		Collections: make(map[string]collectionHealth),
+	}
+	for export, counter := range t.counters {
+		rates := make(map[string]int64)
+		for name, c := range counter.All() {
+			rates[name] = c.Rate()
+		}
+		report.Exports[export] = exportHealth{RatePerMin: rates}
+	}
+	fan, _ := t.fans()
+	for key, c := range fan {
+		health := collectionHealth{Buffered: len(c)}
+		if v, ok := t.activity.Get(key); ok {
+			a := v.(activity)
+			health.LastOp = &a.At
+			health.LagMs = a.LagMs
+		}
+		report.Collections[key] = health
+	}
+	if v, ok := t.activity.Get("latest"); ok {
+		a := v.(activity)
+		report.LastOp = &a.At
+		report.LagMs = a.LagMs
+	}
+	if v, ok := t.checkpoint.Get("saved"); ok {
+		saved := v.(checkpointSave)
+		report.Checkpoint = &saved
+	}
+	return report
+}
+
+// readiness checks the connections, how recent and how far
+// behind the last op is, and the last checkpoint save
+func (t *Tailer) readiness(env Env) healthReport {
+	report := t.details()
+	report.Checks = make(map[string]string)
+	ctx, cancel := context.WithTimeout(context.Background(), healthPingTimeout)
+	defer cancel()
+	check := func(name string, err error) {
+		report.Checks[name] = "ok"
+		if err != nil {
+			report.Checks[name] = err.Error()
+		}
+	}
+	check("serving", boolCheck(report.Serving, "tailer is not serving"))
+	check("mongo", t.client.Ping(ctx, nil))
+	if t.clientExport != nil {
+		check("mongo_export", t.clientExport.Ping(ctx, nil))
+	}
+	if t.pg != nil {
+		check("postgres", t.pg.PingContext(ctx))
+	}
+	return checkReadiness(report, env, time.Now())
+}
+
+// checkReadiness adds the idle, lag and checkpoint checks to the
+// checks already in report and sets its status from all of them
+func checkReadiness(report healthReport, env Env, now time.Time) healthReport {
+	if report.Checks == nil {
+		report.Checks = make(map[string]string)
+	}
+	check := func(name string, err error) {
+		report.Checks[name] = "ok"
+		if err != nil {
+			report.Checks[name] = err.Error()
+		}
+	}
+	if env.readyMaxIdle > 0 {
+		check("last_op", boolCheck(report.LastOp != nil && now.Sub(*report.LastOp) <= env.readyMaxIdle, "no op processed within "+env.readyMaxIdle.String()))
+	}
+	if env.readyMaxLag > 0 {
+		check("lag", boolCheck(time.Duration(report.LagMs)*time.Millisecond <= env.readyMaxLag, "lag above "+env.readyMaxLag.String()))
+	}
+	if report.Checkpoint != nil {
+		check("checkpoint", boolCheck(len(report.Checkpoint.Err) == 0, report.Checkpoint.Err))
+	}
+	report.Status = "ok"
+	failed := []string{}
+	for name, result := range report.Checks {
+		if result != "ok" {
+			failed = append(failed, name)
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		report.Status = "failing: " + strings.Join(failed, ",")
+	}
+	return report
+}
+
+type healthError string
+
+func (e healthError) Error() string { return string(e) }
+
+func boolCheck(ok bool, reason string) error {
+	if ok {
+		return nil
+	}
+	return healthError(reason)
+}
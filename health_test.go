@@ -0,0 +1,44 @@
+package moresql_test
+
+import (
+	"time"
+
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestReadiness(c *C) {
+	env, err := m.ParseEnv([]string{"-ready-max-idle=1m", "-ready-max-lag=5s"})
+	c.Assert(err, IsNil)
+	now := time.Now()
+	recent := now.Add(-time.Second)
+	idle := now.Add(-2 * time.Minute)
+
+	status, checks := m.Readiness(env, now, &recent, 1000, "")
+	c.Check(status, Equals, "ok")
+	c.Check(checks, DeepEquals, map[string]string{"last_op": "ok", "lag": "ok", "checkpoint": "ok"})
+
+	status, checks = m.Readiness(env, now, &idle, 1000, "")
+	c.Check(status, Equals, "failing: last_op")
+	c.Check(checks["last_op"], Equals, "no op processed within 1m0s")
+
+	status, _ = m.Readiness(env, now, nil, 0, "")
+	c.Check(status, Equals, "failing: last_op")
+
+	status, checks = m.Readiness(env, now, &recent, 6000, "")
+	c.Check(status, Equals, "failing: lag")
+	c.Check(checks["lag"], Equals, "lag above 5s")
+
+	status, checks = m.Readiness(env, now, &recent, 1000, "flushing 2 rows into users: boom")
+	c.Check(status, Equals, "failing: checkpoint")
+	c.Check(checks["checkpoint"], Equals, "flushing 2 rows into users: boom")
+
+	status, _ = m.Readiness(env, now, &idle, 6000, "boom")
+	c.Check(status, Equals, "failing: checkpoint,lag,last_op")
+
+	env, err = m.ParseEnv(nil)
+	c.Assert(err, IsNil)
+	status, checks = m.Readiness(env, now, &idle, 6000, "")
+	c.Check(status, Equals, "ok")
+	c.Check(checks, DeepEquals, map[string]string{"checkpoint": "ok"})
+}
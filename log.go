@@ -31,7 +31,7 @@ func (hook *WriterHook) Levels() []log.Level {
 	return hook.LogLevels
 }
 
-func SetupLogger(env Env) {
+func SetupLogger(env Env) error {
 	// Alter logging pattern for heroku
 	log.SetOutput(os.Stdout)
 	formatter := &log.TextFormatter{
@@ -45,8 +45,7 @@ func SetupLogger(env Env) {
 	if v := os.Getenv("LOG_LEVEL"); v != "" {
 		l, err := log.ParseLevel(v)
 		if err != nil {
-			log.WithField("level", v).Warn("LOG_LEVEL invalid, choose from debug, info, warn, fatal.")
-			os.Exit(1)
+			return fmt.Errorf("LOG_LEVEL %s invalid, choose from debug, info, warn, fatal", v)
 		}
 
 		logPath := os.Getenv("LOG_PATH")
@@ -99,4 +98,5 @@ func SetupLogger(env Env) {
 	}
 
 	log.WithField("logLevel", log.GetLevel()).Debug("Log Settings")
+	return nil
 }
@@ -0,0 +1,309 @@
+package moresql
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics served in the Prometheus text format on /metrics
+var (
+	readTotal    = newCounterVec("moresql_read_total", "Ops and documents read from mongo", "db", "collection", "export")
+	insertTotal  = newCounterVec("moresql_insert_total", "Inserts written by an export", "db", "collection", "export")
+	updateTotal  = newCounterVec("moresql_update_total", "Updates written by an export", "db", "collection", "export")
+	deleteTotal  = newCounterVec("moresql_delete_total", "Deletes written by an export", "db", "collection", "export")
+	skippedTotal = newCounterVec("moresql_skipped_total", "Ops not sent to an export", "db", "collection", "export")
+	errorsTotal  = newCounterVec("moresql_errors_total", "Writes an export failed", "db", "collection", "export")
+
+	writeDuration = newHistogramVec("moresql_write_duration_seconds", "Latency of the writes of an export",
+		[]float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}, "export")
+
+	replicationLag = newGaugeVec("moresql_replication_lag_milliseconds", "Time between an op in mongo and its processing", "db", "collection")
+	fanDepth       = newGaugeFunc("moresql_fan_depth", "Ops buffered in the channel of a db.collection.export", "db", "collection", "export")
+	overflowDepth  = newGaugeFunc("moresql_overflow_depth", "Ops buffered in the overflow lanes shared by every fan")
+)
+
+// collector is a metric family written by MetricsHandler
+type collector interface {
+	write(w io.Writer)
+}
+
+var (
+	collectorsMu sync.Mutex
+	collectors   []collector
+)
+
+func register(c collector) {
+	collectorsMu.Lock()
+	defer collectorsMu.Unlock()
+	collectors = append(collectors, c)
+}
+
+// MetricsHandler serves every metric in the Prometheus text format
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteMetrics(w)
+	})
+}
+
+// WriteMetrics writes every metric in the Prometheus text format
+func WriteMetrics(w io.Writer) {
+	collectorsMu.Lock()
+	registered := append([]collector{}, collectors...)
+	collectorsMu.Unlock()
+	buf := bufio.NewWriter(w)
+	for _, c := range registered {
+		c.write(buf)
+	}
+	buf.Flush()
+}
+
+// series is the label values of a single time series
+type series []string
+
+func (s series) key() string {
+	return strings.Join(s, "\xff")
+}
+
+func formatLabels(names []string, values series, extra ...string) string {
+	pairs := []string{}
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escapeLabel(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, extra[i], escapeLabel(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeHeader(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// valueVec holds one value per series, shared by counters and gauges
+type valueVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	mu     sync.Mutex
+	series map[string]series
+	values map[string]float64
+}
+
+func newValueVec(name string, help string, kind string, labels []string) *valueVec {
+	v := &valueVec{name: name, help: help, kind: kind, labels: labels, series: make(map[string]series), values: make(map[string]float64)}
+	register(v)
+	return v
+}
+
+func (v *valueVec) update(fn func(float64) float64, values ...string) {
+	key := series(values).key()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.series[key]; !ok {
+		v.series[key] = append(series{}, values...)
+	}
+	v.values[key] = fn(v.values[key])
+}
+
+func (v *valueVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.values) == 0 {
+		return
+	}
+	writeHeader(w, v.name, v.help, v.kind)
+	keys := []string{}
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, v.series[key]), formatValue(v.values[key]))
+	}
+}
+
+// counterVec is a counter per label values
+type counterVec struct{ *valueVec }
+
+func newCounterVec(name string, help string, labels ...string) counterVec {
+	return counterVec{newValueVec(name, help, "counter", labels)}
+}
+
+func (c counterVec) Inc(values ...string) {
+	c.update(func(v float64) float64 { return v + 1 }, values...)
+}
+
+// Value is the count of the label values, 0 when never incremented
+func (c counterVec) Value(values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[series(values).key()]
+}
+
+// gaugeVec is a gauge per label values
+type gaugeVec struct{ *valueVec }
+
+func newGaugeVec(name string, help string, labels ...string) gaugeVec {
+	return gaugeVec{newValueVec(name, help, "gauge", labels)}
+}
+
+func (g gaugeVec) Set(value float64, values ...string) {
+	g.update(func(float64) float64 { return value }, values...)
+}
+
+// gaugeSample is a value read by a gaugeFunc
+type gaugeSample struct {
+	labels series
+	value  float64
+}
+
+// gaugeFunc reads its values when the metrics are written,
+// the Tailer sets fn once its channels exist
+type gaugeFunc struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	fn     func() []gaugeSample
+}
+
+func newGaugeFunc(name string, help string, labels ...string) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, labels: labels}
+	register(g)
+	return g
+}
+
+func (g *gaugeFunc) Set(fn func() []gaugeSample) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.fn = fn
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	g.mu.Lock()
+	fn := g.fn
+	g.mu.Unlock()
+	if fn == nil {
+		return
+	}
+	samples := fn()
+	sort.Slice(samples, func(i, j int) bool { return samples[i].labels.key() < samples[j].labels.key() })
+	writeHeader(w, g.name, g.help, "gauge")
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, s.labels), formatValue(s.value))
+	}
+}
+
+// histogramVec counts observations in cumulative buckets per label values
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogram
+}
+
+type histogram struct {
+	labels series
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogram)}
+	register(h)
+	return h
+}
+
+func (h *histogramVec) Observe(value float64, values ...string) {
+	key := series(values).key()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{labels: append(series{}, values...), counts: make([]uint64, len(h.buckets))}
+		h.series[key] = s
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// Since observes the seconds elapsed since start
+func (h *histogramVec) Since(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.series) == 0 {
+		return
+	}
+	writeHeader(w, h.name, h.help, "histogram")
+	keys := []string{}
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labels, "le", formatValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, s.labels), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, s.labels), s.count)
+	}
+}
+
+// channelDepths reports the ops buffered in the Tailer's
+// fans and overflow lanes on /metrics
+func (t *Tailer) channelDepths(overflow []chan Op) {
+	fanDepth.Set(func() []gaugeSample {
+		samples := []gaugeSample{}
+		fan, _ := t.fans()
+		for key, c := range fan {
+			db, collection, export := splitFanKey(key)
+			samples = append(samples, gaugeSample{labels: series{db, collection, export}, value: float64(len(c))})
+		}
+		return samples
+	})
+	overflowDepth.Set(func() []gaugeSample {
+		depth := 0
+		for _, c := range overflow {
+			depth += len(c)
+		}
+		return []gaugeSample{{value: float64(depth)}}
+	})
+}
@@ -0,0 +1,27 @@
+package moresql_test
+
+import (
+	"bytes"
+	"strings"
+
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestWriteMetrics(c *C) {
+	m.ObserveTestMetrics()
+	var buf bytes.Buffer
+	m.WriteMetrics(&buf)
+	expected := `# HELP moresql_test_total Test counter
+# TYPE moresql_test_total counter
+moresql_test_total{db="db",collection="a\"b\\c\n"} 1
+# HELP moresql_test_seconds Test histogram
+# TYPE moresql_test_seconds histogram
+moresql_test_seconds_bucket{export="pg",le="0.5"} 1
+moresql_test_seconds_bucket{export="pg",le="1"} 2
+moresql_test_seconds_bucket{export="pg",le="+Inf"} 3
+moresql_test_seconds_sum{export="pg"} 4
+moresql_test_seconds_count{export="pg"} 3
+`
+	c.Check(strings.Contains(buf.String(), expected), Equals, true, Commentf("%s", buf.String()))
+}
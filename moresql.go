@@ -2,15 +2,12 @@ package moresql
 
 import (
 	"context"
-	"flag"
+	"expvar"
 	"fmt"
 	"net/http"
-	"sync"
 	"time"
 
-	"github.com/jmoiron/sqlx"
 	log "github.com/sirupsen/logrus"
-	"go.mongodb.org/mongo-driver/mongo"
 )
 
 const (
@@ -27,6 +24,18 @@ const (
 	// checkpointFrequency frequency at which checkpointing is saved to DB
 	checkpointFrequency = time.Duration(30) * time.Second
 
+	// reconnectBaseDelay and reconnectMaxDelay bound the backoff
+	// between restarts of the mongo tail
+	reconnectBaseDelay = time.Duration(1) * time.Second
+	reconnectMaxDelay  = time.Duration(60) * time.Second
+
+	// connectTimeout bounds the ping checking a new mongo connection
+	connectTimeout = time.Duration(10) * time.Second
+
+	// monitorShutdownTimeout bounds the requests the
+	// monitor finishes once the command is done
+	monitorShutdownTimeout = time.Duration(5) * time.Second
+
 	// type of tail log
 	optLog       = "optlog"
 	changeStream = "change-stream"
@@ -37,55 +46,77 @@ const (
 	mongoExport    = "mongo"
 )
 
-var wg sync.WaitGroup
-
-func Run() {
-	c := Commands{}
+// Run is the moresql command: it reads the flags and environment,
+// connects and runs until done, ctx is done or it fails
+func Run(ctx context.Context) error {
 	env := FetchEnvsAndFlags()
-	SetupLogger(env)
-	ExitUnlessValidEnv(env)
-
+	if err := SetupLogger(env); err != nil {
+		return err
+	}
+	if err := ValidateEnv(env); err != nil {
+		return err
+	}
 	log.WithFields(log.Fields{"params": fmt.Sprintf("%+v", env)}).Info("Environment")
-	config := LoadConfig(env.configFile)
-	var pg *sqlx.DB
-	if len(env.urls.postgres) > 0 {
-		pg = GetPostgresConnection(env)
-		log.Info("Connected to postgres")
-		defer pg.Close()
+	if env.createTableSQL {
+		c := Commands{}
+		c.CreateTableSQL()
+		return nil
 	}
-
-	// TODO: should this run for each execution of application
-	if env.validatePostgres {
-		c.ValidateTablesAndColumns(config, pg)
+	if len(env.memprofile) > 0 {
+		if err := WriteMemProfile(ctx, env.memprofile); err != nil {
+			return err
+		}
 	}
 
-	var client *mongo.Client
-	if len(env.urls.mongo) > 0 {
-		client = GetMongoConnection(env.urls.mongo)
-		defer client.Disconnect(context.TODO())
-		log.Info("Connected to mongo")
+	o, err := OpenOptions(ctx, env)
+	if err != nil {
+		return err
 	}
+	defer o.Close()
 
-
-	var clientExport *mongo.Client
-	if len(env.urls.mongoExport) > 0 {
-		clientExport = GetMongoConnection(env.urls.mongoExport)
-		log.Info("Connected to mongo export")
-		defer clientExport.Disconnect(context.TODO())
+	if env.monitor {
+		return runWithMonitor(ctx, o)
 	}
+	return o.Run(ctx)
+}
 
-	if env.monitor {
-		go http.ListenAndServe(":1234", nil)
+// monitorServer serves expvar, /metrics, /healthz, /readyz
+// and with -enable-admin the admin API on -monitor-addr
+func monitorServer(env Env) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/metrics", MetricsHandler())
+	HandleHealth(mux, env)
+	if env.enableAdmin {
+		HandleAdmin(mux, env)
 	}
+	return &http.Server{Addr: env.monitorAddr, Handler: mux}
+}
 
-	switch {
-	case env.sync:
-		FullSync(config, pg, client, clientExport)
-	case env.tail:
-		Tail(config, pg, env, client , clientExport)
-	case env.syncFile:
-		SyncFile(config, pg, env)
+// runWithMonitor runs o while serving the monitor, which is shut down
+// once o is done. When the monitor fails o is cancelled and the
+// monitor's error returned.
+func runWithMonitor(ctx context.Context, o Options) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	monitor := monitorServer(o.Env)
+	failed := make(chan error, 1)
+	go func() {
+		if err := monitor.ListenAndServe(); err != http.ErrServerClosed {
+			failed <- err
+			cancel()
+		}
+	}()
+	err := o.Run(ctx)
+	shutdownCtx, done := context.WithTimeout(context.Background(), monitorShutdownTimeout)
+	defer done()
+	if shutdownErr := monitor.Shutdown(shutdownCtx); shutdownErr != nil {
+		log.WithField("error", shutdownErr).Warn("Unable to shut down the monitor")
+	}
+	select {
+	case monitorErr := <-failed:
+		return fmt.Errorf("serving the monitor on %s: %s", o.Env.monitorAddr, monitorErr)
 	default:
-		flag.Usage()
+		return err
 	}
 }
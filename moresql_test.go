@@ -28,7 +28,7 @@ func (s *MySuite) TestBuildUpsertStatement(c *C) {
 	o := m.Statement{collection}
 
 	sql := o.BuildUpsert()
-	expected := `INSERT INTO "categories_in_pg" ("id", "count")
+	expected := `INSERT INTO "categories" ("id", "count")
 VALUES (:id, :count)
 ON CONFLICT ("id")
 DO UPDATE SET "count" = :count;`
@@ -88,3 +88,50 @@ func (s *MySuite) TestBuildDeleteStatement(c *C) {
 	expected := `DELETE FROM "categories" WHERE "id" = :_id;`
 	c.Check(sql, Equals, expected)
 }
+
+func bulkCollection() m.Collection {
+	f := m.Field{m.Mongo{"_id", "id"}, m.Export{"id", "text"}}
+	f2 := m.Field{m.Mongo{"count", "text"}, m.Export{"count", "text"}}
+	return m.Collection{
+		Name:       "categories",
+		Schema:     "public",
+		Fields:     m.Fields{"_id": f, "count": f2},
+		ExtraProps: "JSONB",
+	}
+}
+
+func (s *MySuite) TestBuildBulkUpsertStatement(c *C) {
+	o := m.Statement{bulkCollection()}
+	sql := o.BuildBulkUpsert(2)
+	expected := `INSERT INTO public."categories" ("id", "count", "_extra_props")
+VALUES ($1, $2, $3),
+($4, $5, $6)
+ON CONFLICT ("id")
+DO UPDATE SET "count" = EXCLUDED."count", "_extra_props" = EXCLUDED."_extra_props";`
+	c.Check(sql, Equals, expected)
+	c.Check(o.BulkRowLimit(), Equals, 21845)
+}
+
+func (s *MySuite) TestBuildBulkDeleteStatement(c *C) {
+	o := m.Statement{bulkCollection()}
+	sql := o.BuildBulkDelete(3)
+	expected := `DELETE FROM public."categories" WHERE "id" IN ($1, $2, $3);`
+	c.Check(sql, Equals, expected)
+}
+
+func (s *MySuite) TestBulkValues(c *C) {
+	o := m.Statement{bulkCollection()}
+	data := map[string]interface{}{"_id": "abc", "id": "abc", "count": 2, "_extra_props": nil}
+	c.Check(o.BulkValues(data), DeepEquals, []interface{}{"abc", 2, nil})
+}
+
+func (s *MySuite) TestBuildCreateTableStatement(c *C) {
+	o := m.Statement{bulkCollection()}
+	sql := o.BuildCreateTable()
+	expected := `CREATE TABLE IF NOT EXISTS public."categories" (
+    "id" text NOT NULL,
+    "count" text NULL,
+    "_extra_props" JSONB NULL
+);`
+	c.Check(sql, Equals, expected)
+}
@@ -0,0 +1,125 @@
+package moresql
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// WatchedNamespaces are the sorted db.collection of the config, once each
+// however many exports they are written to
+func WatchedNamespaces(config Config) []string {
+	namespaces := []string{}
+	for dbName, db := range config {
+		for collectionName := range db.Collections {
+			namespaces = append(namespaces, dbName+"."+collectionName)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
+
+// watchedDatabases are the sorted dbs of the config with a collection
+func watchedDatabases(config Config) []string {
+	dbs := []string{}
+	for dbName, db := range config {
+		if len(db.Collections) > 0 {
+			dbs = append(dbs, dbName)
+		}
+	}
+	sort.Strings(dbs)
+	return dbs
+}
+
+// NamespaceFilter keeps the ops of the configured collections, and the
+// commands of their dbs as drops are reported on db.$cmd and invalidate
+// the change streams. The oplog query already matches the namespaces,
+// this also filters the change streams.
+func NamespaceFilter(config Config) gtm.OpFilter {
+	watched := make(map[string]bool)
+	for _, ns := range WatchedNamespaces(config) {
+		watched[ns] = true
+	}
+	dbs := make(map[string]bool)
+	for _, db := range watchedDatabases(config) {
+		dbs[db] = true
+	}
+	return func(op *gtm.Op) bool {
+		return watched[op.Namespace] || (op.IsCommand() && dbs[op.GetDatabase()])
+	}
+}
+
+// OplogQuery selects the oplog entries after the timestamp after of the
+// configured collections and the commands of their dbs, so that other
+// namespaces never leave mongo
+func OplogQuery(config Config, after primitive.Timestamp) bson.D {
+	commands := bson.A{}
+	for _, db := range watchedDatabases(config) {
+		commands = append(commands, db+".$cmd")
+	}
+	namespaces := bson.A{}
+	for _, ns := range WatchedNamespaces(config) {
+		namespaces = append(namespaces, ns)
+	}
+	return bson.D{
+		{Key: "ts", Value: bson.D{{Key: "$gt", Value: after}}},
+		{Key: "fromMigrate", Value: bson.D{{Key: "$exists", Value: false}}},
+		{Key: "$or", Value: bson.A{
+			bson.D{
+				{Key: "op", Value: bson.D{{Key: "$in", Value: bson.A{"i", "u", "d"}}}},
+				{Key: "ns", Value: bson.D{{Key: "$in", Value: namespaces}}},
+			},
+			bson.D{
+				{Key: "op", Value: "c"},
+				{Key: "ns", Value: bson.D{{Key: "$in", Value: commands}}},
+			},
+		}},
+	}
+}
+
+// conditionSource is the mongo field exported as the collection's
+// condition_field, empty when the collection has no condition
+func conditionSource(c Collection) string {
+	if len(c.ConditionField) == 0 || len(c.ConditionValue) == 0 {
+		return ""
+	}
+	for source, field := range c.Fields {
+		if field.Export.Name == c.ConditionField {
+			return source
+		}
+	}
+	return ""
+}
+
+// ChangeStreamPipeline matches condition_field/condition_value on the
+// server so that documents SanitizeData would skip never leave mongo.
+// Events without a document, ie deletes and drops, always pass. A
+// collection copied whole by an all_field mongo export is not filtered
+// as that export ignores the condition.
+func ChangeStreamPipeline(config Config, exports []string) gtm.PipelineBuilder {
+	return func(namespace string, changeStream bool) ([]interface{}, error) {
+		if !changeStream {
+			return nil, nil
+		}
+		parts := strings.SplitN(namespace, ".", 2)
+		if len(parts) != 2 {
+			return nil, nil
+		}
+		c, ok := config[parts[0]].Collections[parts[1]]
+		if !ok || (c.AllField && HasTypeExport(exports, mongoExport)) {
+			return nil, nil
+		}
+		source := conditionSource(c)
+		if len(source) == 0 {
+			return nil, nil
+		}
+		match := bson.D{{Key: "$match", Value: bson.D{{Key: "$or", Value: bson.A{
+			bson.D{{Key: "operationType", Value: bson.D{{Key: "$nin", Value: bson.A{"insert", "update", "replace"}}}}},
+			bson.D{{Key: "fullDocument." + source, Value: c.ConditionValue}},
+		}}}}}
+		return []interface{}{match}, nil
+	}
+}
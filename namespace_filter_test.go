@@ -0,0 +1,74 @@
+package moresql_test
+
+import (
+	"github.com/rwynn/gtm"
+	m "github.com/zph/moresql"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestWatchedNamespaces(c *C) {
+	config := m.Config{"db": m.DB{Collections: m.Collections{"users": m.Collection{Name: "users"}, "orders": m.Collection{Name: "orders"}}}}
+	c.Check(m.WatchedNamespaces(config), DeepEquals, []string{"db.orders", "db.users"})
+
+	filter := m.NamespaceFilter(config)
+	c.Check(filter(&gtm.Op{Namespace: "db.users", Operation: "i"}), Equals, true)
+	c.Check(filter(&gtm.Op{Namespace: "db.other", Operation: "i"}), Equals, false)
+	c.Check(filter(&gtm.Op{Namespace: "db.$cmd", Operation: "c"}), Equals, true)
+	c.Check(filter(&gtm.Op{Namespace: "other.$cmd", Operation: "c"}), Equals, false)
+}
+
+func (s *MySuite) TestOplogQuery(c *C) {
+	config := m.Config{
+		"db":    m.DB{Collections: m.Collections{"users": m.Collection{Name: "users"}, "orders": m.Collection{Name: "orders"}}},
+		"empty": m.DB{Collections: m.Collections{}},
+	}
+	after := primitive.Timestamp{T: 1485147998, I: 1}
+	c.Check(m.OplogQuery(config, after), DeepEquals, bson.D{
+		{Key: "ts", Value: bson.D{{Key: "$gt", Value: after}}},
+		{Key: "fromMigrate", Value: bson.D{{Key: "$exists", Value: false}}},
+		{Key: "$or", Value: bson.A{
+			bson.D{
+				{Key: "op", Value: bson.D{{Key: "$in", Value: bson.A{"i", "u", "d"}}}},
+				{Key: "ns", Value: bson.D{{Key: "$in", Value: bson.A{"db.orders", "db.users"}}}},
+			},
+			bson.D{
+				{Key: "op", Value: "c"},
+				{Key: "ns", Value: bson.D{{Key: "$in", Value: bson.A{"db.$cmd"}}}},
+			},
+		}},
+	})
+}
+
+func (s *MySuite) TestChangeStreamPipeline(c *C) {
+	orders := m.Collection{
+		Name:           "orders",
+		Fields:         m.Fields{"delivery": m.Field{Export: m.Export{Name: "delivery_type"}}},
+		ConditionField: "delivery_type",
+		ConditionValue: "ahamove",
+	}
+	config := m.Config{"db": m.DB{Collections: m.Collections{"orders": orders, "users": m.Collection{Name: "users"}}}}
+
+	stages, err := m.ChangeStreamPipeline(config, []string{"postgres"})("db.orders", true)
+	c.Assert(err, IsNil)
+	c.Check(stages, HasLen, 1)
+
+	stages, _ = m.ChangeStreamPipeline(config, []string{"postgres"})("db.users", true)
+	c.Check(stages, IsNil)
+
+	orders.AllField = true
+	config["db"].Collections["orders"] = orders
+	stages, _ = m.ChangeStreamPipeline(config, []string{"postgres", "mongo"})("db.orders", true)
+	c.Check(stages, IsNil)
+}
+
+func (s *MySuite) TestIsInvalidate(c *C) {
+	config := m.Config{"db": m.DB{Collections: m.Collections{"users": m.Collection{Name: "users"}}}}
+	c.Check(m.IsInvalidate(&gtm.Op{Namespace: "db.users", Operation: "c", Data: map[string]interface{}{"drop": "users"}}, config), Equals, true)
+	c.Check(m.IsInvalidate(&gtm.Op{Namespace: "db.other", Operation: "c", Data: map[string]interface{}{"drop": "other"}}, config), Equals, false)
+	c.Check(m.IsInvalidate(&gtm.Op{Namespace: "db.cmd", Operation: "c", Data: map[string]interface{}{"dropDatabase": "db"}}, config), Equals, true)
+	c.Check(m.IsInvalidate(&gtm.Op{Namespace: "other.cmd", Operation: "c", Data: map[string]interface{}{"dropDatabase": "other"}}, config), Equals, false)
+	c.Check(m.IsInvalidate(&gtm.Op{Namespace: "db.cmd", Operation: "c", Data: map[string]interface{}{"create": "users"}}, config), Equals, false)
+	c.Check(m.IsInvalidate(&gtm.Op{Namespace: "db.users", Operation: "i", Data: map[string]interface{}{"drop": "users"}}, config), Equals, false)
+}
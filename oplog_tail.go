@@ -0,0 +1,161 @@
+package moresql
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rwynn/gtm"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// oplogRequeryDelay is the wait before querying the
+// oplog again once the tailable cursor is dead
+const oplogRequeryDelay = time.Second
+
+// oplogTail reads the oplog like gtm does, except that its query only
+// matches the configured namespaces. gtm's own oplog query can't be
+// changed, so every op of the cluster would be sent to moresql.
+type oplogTail struct {
+	client *mongo.Client
+	o      *gtm.Options
+	config Config
+	opCtx  *gtm.OpCtx
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// startOplogTail tails the oplog of client for the collections of config,
+// fetching the documents of updates with o's workers like gtm.Start
+func startOplogTail(client *mongo.Client, o *gtm.Options, config Config) gtmTail {
+	o.SetDefaults()
+	ctx, cancel := context.WithCancel(context.Background())
+	tail := &oplogTail{
+		client: client,
+		o:      o,
+		config: config,
+		// Flush only sends to OpC and ErrC
+		opCtx:  &gtm.OpCtx{OpC: make(gtm.OpChan, o.ChannelSize), ErrC: make(chan error, o.ChannelSize)},
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	workers := []string{}
+	for i := 1; i <= o.WorkerCount; i++ {
+		workers = append(workers, strconv.Itoa(i))
+	}
+	inOps := []gtm.OpChan{}
+	for _, worker := range workers {
+		in := make(gtm.OpChan, o.ChannelSize)
+		inOps = append(inOps, in)
+		tail.wg.Add(1)
+		go tail.fetch(in, gtm.OpFilterForOrdering(o.Ordering, workers, worker))
+	}
+	tail.wg.Add(1)
+	go tail.read(inOps)
+	return gtmTail{ops: tail.opCtx.OpC, errs: tail.opCtx.ErrC, stop: tail.stop}
+}
+
+// stop waits for the reader and workers, then closes the channels
+func (tail *oplogTail) stop() {
+	tail.cancel()
+	tail.wg.Wait()
+	close(tail.opCtx.OpC)
+	close(tail.opCtx.ErrC)
+}
+
+// fail reports err and stops reading,
+// Read restarts the tail when it recovers
+func (tail *oplogTail) fail(err error) {
+	select {
+	case tail.opCtx.ErrC <- err:
+	case <-tail.ctx.Done():
+	}
+}
+
+func (tail *oplogTail) read(inOps []gtm.OpChan) {
+	defer tail.wg.Done()
+	after, err := tail.o.After(tail.client, tail.o)
+	if err != nil {
+		tail.fail(err)
+		return
+	}
+	oplog := tail.client.Database(tail.o.OpLogDatabaseName).Collection(tail.o.OpLogCollectionName)
+	opts := options.Find().SetSort(bson.D{{Key: "$natural", Value: 1}}).SetCursorType(options.TailableAwait)
+	for tail.ctx.Err() == nil {
+		cursor, err := oplog.Find(tail.ctx, OplogQuery(tail.config, after), opts)
+		if err != nil {
+			tail.fail(err)
+			return
+		}
+		for cursor.Next(tail.ctx) {
+			var entry gtm.OpLog
+			if err := cursor.Decode(&entry); err != nil {
+				cursor.Close(context.Background())
+				tail.fail(err)
+				return
+			}
+			op := &gtm.Op{Source: gtm.OplogQuerySource}
+			ok, err := op.ParseLogEntry(&entry, tail.o)
+			if err != nil {
+				cursor.Close(context.Background())
+				tail.fail(err)
+				return
+			}
+			after = op.Timestamp
+			if !ok || (tail.o.Filter != nil && !tail.o.Filter(op)) {
+				continue
+			}
+			// Each worker only keeps the ops of its ordering filter
+			for _, in := range inOps {
+				select {
+				case in <- op:
+				case <-tail.ctx.Done():
+				}
+			}
+		}
+		err = cursor.Err()
+		cursor.Close(context.Background())
+		if err != nil && tail.ctx.Err() == nil {
+			tail.fail(err)
+			return
+		}
+		// A tailable cursor dies when nothing matched yet,
+		// wait before querying again
+		select {
+		case <-time.After(oplogRequeryDelay):
+		case <-tail.ctx.Done():
+		}
+	}
+}
+
+// fetch buffers the ops of a worker, Flush fetches
+// the documents of updates then sends the ops in order
+func (tail *oplogTail) fetch(in gtm.OpChan, filter gtm.OpFilter) {
+	defer tail.wg.Done()
+	buf := &gtm.OpBuf{BufferSize: tail.o.BufferSize, BufferDuration: tail.o.BufferDuration}
+	timer := time.NewTimer(buf.BufferDuration)
+	timer.Stop()
+	for {
+		select {
+		case <-tail.ctx.Done():
+			return
+		case <-timer.C:
+			buf.Flush(tail.client, tail.opCtx, tail.o)
+		case op := <-in:
+			if !filter(op) {
+				continue
+			}
+			buf.Append(op)
+			if buf.IsFull() {
+				timer.Stop()
+				buf.Flush(tail.client, tail.opCtx, tail.o)
+			} else if buf.HasOne() {
+				timer.Reset(buf.BufferDuration)
+			}
+		}
+	}
+}
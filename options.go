@@ -0,0 +1,97 @@
+package moresql
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Options is what a run of moresql needs. The moresql command builds it
+// from its flags and environment with OpenOptions, a program embedding
+// moresql may build it with ParseEnv and the connections it already has.
+type Options struct {
+	Config      Config
+	Env         Env
+	Postgres    *sqlx.DB
+	Mongo       *mongo.Client
+	MongoExport *mongo.Client
+}
+
+// OpenOptions loads the config file of env and connects to each of its
+// urls, Close releases the connections
+func OpenOptions(ctx context.Context, env Env) (o Options, err error) {
+	o.Env = env
+	defer func() {
+		if err != nil {
+			o.Close()
+		}
+	}()
+	if o.Config, err = LoadConfig(env.configFile); err != nil {
+		return o, fmt.Errorf("loading %s: %s", env.configFile, err)
+	}
+	if len(env.urls.postgres) > 0 {
+		if o.Postgres, err = GetPostgresConnection(env); err != nil {
+			return o, err
+		}
+		log.Info("Connected to postgres")
+	}
+	if len(env.urls.mongo) > 0 {
+		if o.Mongo, err = GetMongoConnection(ctx, env.urls.mongo, env); err != nil {
+			return o, err
+		}
+		log.Info("Connected to mongo")
+	}
+	if len(env.urls.mongoExport) > 0 {
+		if o.MongoExport, err = GetMongoConnection(ctx, env.urls.mongoExport, env); err != nil {
+			return o, fmt.Errorf("mongo export: %s", err)
+		}
+		log.Info("Connected to mongo export")
+	}
+	return o, nil
+}
+
+// Close disconnects the connections of o
+func (o Options) Close() {
+	if o.Postgres != nil {
+		o.Postgres.Close()
+	}
+	if o.Mongo != nil {
+		o.Mongo.Disconnect(context.Background())
+	}
+	if o.MongoExport != nil {
+		o.MongoExport.Disconnect(context.Background())
+	}
+}
+
+// Run does what the flags of o.Env ask for: validate or plan the postgres
+// schema, replay dead letters, bootstrap, full sync, tail or sync a file.
+// Tailing runs until ctx is done, which shuts it down gracefully, or it
+// fails.
+func (o Options) Run(ctx context.Context) error {
+	c := Commands{}
+	env := o.Env
+	switch {
+	case env.createTableSQL:
+		c.CreateTableSQL()
+		return nil
+	case env.validatePostgres:
+		return c.ValidateTablesAndColumns(o.Config, strings.Split(env.exports, ","), o.Postgres)
+	case env.planSchema || env.applySchema:
+		return c.Schema(o.Config, strings.Split(env.exports, ","), o.Postgres, env.applySchema)
+	case env.replayDeadLetters:
+		return ReplayDeadLetters(ctx, o)
+	case env.bootstrap:
+		return Bootstrap(ctx, o)
+	case env.sync:
+		return FullSync(ctx, o)
+	case env.tail:
+		return Tail(ctx, o)
+	case env.syncFile:
+		return SyncFile(o.Config, o.Postgres, env)
+	}
+	return fmt.Errorf("nothing to run, set -full-sync, -tail, -bootstrap, -sync-file or -replay-dead-letters")
+}
@@ -0,0 +1,32 @@
+package moresql_test
+
+import (
+	"context"
+
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestParseEnv(c *C) {
+	_, err := m.ParseEnv([]string{"-not-a-flag"})
+	c.Check(err, ErrorMatches, ".*not-a-flag.*")
+
+	env, err := m.ParseEnv([]string{"-tail"})
+	c.Assert(err, IsNil)
+	c.Check(m.ValidateEnv(env), ErrorMatches, "missing config file path.*")
+
+	env, err = m.ParseEnv([]string{"-config-file=moresql.json", "-exports=nope"})
+	c.Assert(err, IsNil)
+	c.Check(m.ValidateEnv(env), ErrorMatches, "-exports nope must only list registered exporters.*")
+
+	env, err = m.ParseEnv([]string{"-config-file=moresql.json", "-bootstrap"})
+	c.Assert(err, IsNil)
+	c.Check(m.ValidateEnv(env), ErrorMatches, "-bootstrap requires -checkpoint.*")
+}
+
+func (s *MySuite) TestOptionsRunWithoutCommand(c *C) {
+	env, err := m.ParseEnv(nil)
+	c.Assert(err, IsNil)
+	err = m.Options{Env: env}.Run(context.Background())
+	c.Check(err, ErrorMatches, "nothing to run.*")
+}
@@ -0,0 +1,359 @@
+package moresql
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rwynn/gtm"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// Values of -on-stream-invalidate, what the Tailer does when
+// mongo can no longer resume from the checkpoint
+const (
+	streamPolicyFail       = "fail"
+	streamPolicyResnapshot = "resnapshot"
+	streamPolicyResumeNow  = "resume-now"
+)
+
+// reconnects counts every restart of the mongo tail
+var reconnects = expvar.NewInt("reconnects")
+
+type streamState int
+
+const (
+	// streamRecoverable restarts the tail from the last safe checkpoint
+	streamRecoverable streamState = iota
+	// streamPositionLost applies -on-stream-invalidate
+	streamPositionLost
+	// streamFatal exits
+	streamFatal
+)
+
+func (s streamState) String() string {
+	switch s {
+	case streamRecoverable:
+		return "recoverable"
+	case streamPositionLost:
+		return "position lost"
+	default:
+		return "fatal"
+	}
+}
+
+// positionLostCodes are the server codes returned when a change stream
+// can't be resumed from its token or the oplog no longer holds the
+// checkpoint: CappedPositionLost, InvalidResumeToken, ChangeStreamFatalError,
+// ChangeStreamHistoryLost and the pre 4.2 resume failures
+var positionLostCodes = map[int32]bool{
+	136:   true,
+	260:   true,
+	280:   true,
+	286:   true,
+	40576: true,
+	40585: true,
+	40615: true,
+}
+
+// fatalCodes are errors a reconnect can't fix: Unauthorized,
+// AuthenticationFailed and change streams without a replica set
+var fatalCodes = map[int32]bool{
+	13:    true,
+	18:    true,
+	40573: true,
+}
+
+// classifyStreamError decides how Read handles an error sent by gtm.
+// Anything not known to be fatal or to have lost the position is
+// retried, gtm reports most network failures as plain errors.
+func classifyStreamError(err error) streamState {
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) {
+		switch {
+		case positionLostCodes[cmdErr.Code] || cmdErr.HasErrorLabel("NonResumableChangeStreamError"):
+			return streamPositionLost
+		case fatalCodes[cmdErr.Code]:
+			return streamFatal
+		}
+		return streamRecoverable
+	}
+	if strings.Contains(err.Error(), "ChangeStreamHistoryLost") {
+		return streamPositionLost
+	}
+	return streamRecoverable
+}
+
+// isInvalidate reports whether op is a drop of a configured collection
+// or database, which invalidates its change stream. gtm consumes the
+// invalidate event itself and resumes from the current time, the drop
+// preceding it is all that is visible.
+func isInvalidate(op *gtm.Op, config Config) bool {
+	if op.Operation != "c" || op.Data == nil {
+		return false
+	}
+	if coll, ok := op.Data["drop"].(string); ok {
+		_, configured := config[op.GetDatabase()].Collections[coll]
+		return configured
+	}
+	if db, ok := op.Data["dropDatabase"].(string); ok {
+		return len(config[db].Collections) > 0
+	}
+	return false
+}
+
+// stopGtm stops g in the background, draining its
+// channels so that gtm's goroutines can exit
+func stopGtm(g gtmTail) {
+	go func() {
+		for range g.ops {
+		}
+	}()
+	go func() {
+		for range g.errs {
+		}
+	}()
+	go g.stop()
+}
+
+// tailOptions builds the gtm options starting from position,
+// using its resume tokens when tailing change streams
+func (t *Tailer) tailOptions(position MoresqlMetadata) (*gtm.Options, error) {
+	options, err := t.NewOptionsFromTimestamp(position.Timestamp(), t.env.replayDuration)
+	if err != nil {
+		return nil, err
+	}
+	if t.env.tailType == changeStream {
+		t.ChangeStreamOptions(options)
+		t.ResumeTokenOptions(options, position)
+	}
+	return options, nil
+}
+
+// safePosition is the last checkpoint committed by every export,
+// or origin when nothing has been committed since Read started
+func (t *Tailer) safePosition(origin MoresqlMetadata) MoresqlMetadata {
+	position := origin
+	if latest, ok := t.checkpoint.Get("latest"); ok && latest != nil {
+		position = latest.(MoresqlMetadata)
+		position.ResumeTokens = ""
+		if tokens := t.resumeTokens(); len(tokens) > 0 {
+			position.ResumeTokens, _ = EncodeResumeTokens(tokens)
+		}
+	}
+	return position
+}
+
+// readPosition is the latest timestamp and the resume token
+// of each change stream of the ops dispatched by Read
+type readPosition struct {
+	ts     primitive.Timestamp
+	tokens map[string]interface{}
+}
+
+func (r *readPosition) record(op *gtm.Op) {
+	if ts := op.Timestamp; ts.T > r.ts.T || (ts.T == r.ts.T && ts.I > r.ts.I) {
+		r.ts = ts
+	}
+	if token := op.ResumeToken; token.ResumeToken != nil {
+		if r.tokens == nil {
+			r.tokens = make(map[string]interface{})
+		}
+		r.tokens[token.StreamID] = token.ResumeToken
+	}
+}
+
+// restartOptions restarts the tail after the ops already dispatched so
+// none is dispatched twice. The oplog restarts after the latest op read.
+// Change streams resume after their last op, or from their checkpoint
+// when none was read, and the streams of added collections start now.
+// When a stream has no token at all, the tail restarts from the safe
+// position and replays the ops since the checkpoint.
+func (t *Tailer) restartOptions(origin MoresqlMetadata, added []string) (*gtm.Options, error) {
+	if t.read.ts.T == 0 {
+		return t.tailOptions(t.safePosition(origin))
+	}
+	options, err := t.NewOptionsFromTimestamp(t.read.ts, t.env.replayDuration)
+	if err != nil {
+		return nil, err
+	}
+	// Even an op of the current second, which the
+	// options would otherwise replace with now
+	ts := t.read.ts
+	options.After = func(*mongo.Client, *gtm.Options) (primitive.Timestamp, error) { return ts, nil }
+	if t.env.tailType != changeStream {
+		return options, nil
+	}
+	t.ChangeStreamOptions(options)
+	tokens := t.resumeTokens()
+	for ns, token := range t.read.tokens {
+		tokens[ns] = token
+	}
+	isAdded := make(map[string]bool)
+	for _, ns := range added {
+		isAdded[ns] = true
+	}
+	for _, ns := range options.ChangeStreamNs {
+		if tokens[ns] == nil && !isAdded[ns] {
+			log.WithField("namespace", ns).Warn("No resume token for change stream, restarting from the checkpoint")
+			return t.tailOptions(t.safePosition(origin))
+		}
+	}
+	options.Token = func(client *mongo.Client, ns string, o *gtm.Options) (interface{}, error) {
+		return tokens[ns], nil
+	}
+	return options, nil
+}
+
+// clearResumeTokens drops the tokens of every stream so that
+// a restart can't resume from a position mongo no longer has
+func (t *Tailer) clearResumeTokens() {
+	for _, key := range t.checkpoint.Keys() {
+		if strings.HasPrefix(key, resumeTokenPrefix) {
+			t.checkpoint.Remove(key)
+		}
+	}
+}
+
+// reconnect stops g and, after a backoff based on attempt, starts a new
+// tail from the last safe checkpoint. It returns false when the Tailer
+// is asked to quit while waiting, or fails.
+func (t *Tailer) reconnect(g gtmTail, origin MoresqlMetadata, attempt int, cause error) (gtmTail, bool) {
+	stopGtm(g)
+	if t.env.reconnectMaxAttempts > 0 && attempt > t.env.reconnectMaxAttempts {
+		t.fail(fmt.Errorf("unable to recover from %s after %d reconnects", cause.Error(), attempt-1))
+		return g, false
+	}
+	backoff := RetryPolicy{BaseDelay: reconnectBaseDelay, MaxDelay: reconnectMaxDelay, Jitter: t.env.retryJitter}
+	delay := backoff.Delay(attempt - 1)
+	log.WithFields(log.Fields{"error": cause, "attempt": attempt, "delay": delay}).Error("Problem reading from mongo, reconnecting")
+	select {
+	case <-t.quit:
+		return g, false
+	case <-t.stop:
+		return g, false
+	case <-time.After(delay):
+	}
+	options, err := t.tailOptions(t.safePosition(origin))
+	if err != nil {
+		t.fail(err)
+		return g, false
+	}
+	reconnects.Add(1)
+	return t.startGtm(options), true
+}
+
+// positionLost stops g and applies -on-stream-invalidate,
+// it returns false when the Tailer fails
+func (t *Tailer) positionLost(g gtmTail, cause string) (gtmTail, bool) {
+	stopGtm(g)
+	log.WithFields(log.Fields{"cause": cause, "policy": t.env.onStreamInvalidate}).Error("Mongo can no longer resume from the checkpoint")
+	switch t.env.onStreamInvalidate {
+	case streamPolicyResumeNow, streamPolicyResnapshot:
+		// Finish what was read so the snapshot and the
+		// new tail can't be overwritten by older ops
+		if !t.waitInflight() {
+			return g, false
+		}
+		t.clearResumeTokens()
+		// A second back so the position is in the past even when
+		// no snapshot is taken, ops replayed from it are idempotent
+		from := time.Now().Add(-time.Second).Unix()
+		position := MoresqlMetadata{AppName: t.env.appName, LastEpoch: from, LastOrdinal: 1}
+		// Everything read was written, later restarts start from here
+		t.checkpoint.Set("latest", position)
+		t.read = readPosition{}
+		if t.env.onStreamInvalidate == streamPolicyResnapshot {
+			if err := t.resnapshot(); err != nil {
+				t.fail(fmt.Errorf("resnapshot: %s", err))
+				return g, false
+			}
+		}
+		options, err := t.tailOptions(position)
+		if err != nil {
+			t.fail(err)
+			return g, false
+		}
+		reconnects.Add(1)
+		return t.startGtm(options), true
+	}
+	t.fail(fmt.Errorf("%s, set -on-stream-invalidate to resnapshot or resume-now to continue", cause))
+	return g, false
+}
+
+// resnapshot full syncs every configured collection from scratch
+func (t *Tailer) resnapshot() error {
+	log.Info("Resnapshotting collections")
+	ClearFullSyncProgress(t.pg, t.env.appName)
+	o := t.options()
+	o.Env.fullSyncOnly, o.Env.fullSyncFilter = "", ""
+	return FullSync(t.ctx, o)
+}
+
+// waitInflight waits until every op dispatched is written, it returns
+// false when the Tailer stops first. Ops held by a paused or full fan
+// stay in flight until the fan is resumed.
+func (t *Tailer) waitInflight() bool {
+	drained := make(chan struct{})
+	go func() {
+		t.inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		return true
+	case <-t.stop:
+	case <-t.quit:
+	case <-t.failed:
+	}
+	return false
+}
+
+// waitTracked waits until the checkpoint tracker has room for another
+// op, it returns false when the Tailer stops first. The tracker fills
+// up when a paused fan keeps the checkpoint from moving.
+func (t *Tailer) waitTracked() bool {
+	if t.tracker == nil || !t.tracker.Full() {
+		return true
+	}
+	log.WithField("limit", maxTrackedOps).Warn("Too many ops waiting for the checkpoint, pausing the tail")
+	for t.tracker.Full() {
+		select {
+		case <-t.tracker.Freed():
+		case <-t.stop:
+			return false
+		case <-t.quit:
+			return false
+		case <-t.failed:
+			return false
+		}
+	}
+	return true
+}
+
+// Reconnects is the number of times the mongo tail was restarted
+func (t *Tailer) Reconnects() int64 {
+	return reconnects.Value()
+}
+
+// isStreamPolicy reports whether s is a valid -on-stream-invalidate
+func isStreamPolicy(s string) bool {
+	switch s {
+	case streamPolicyFail, streamPolicyResnapshot, streamPolicyResumeNow:
+		return true
+	}
+	return false
+}
+
+// originPosition is where Read starts: -replay-second, or the
+// checkpoint with its resume tokens
+func (t *Tailer) originPosition(metadata MoresqlMetadata) MoresqlMetadata {
+	if t.env.replaySecond != 0 {
+		return MoresqlMetadata{AppName: t.env.appName, LastEpoch: t.env.replaySecond, LastOrdinal: 1}
+	}
+	return metadata
+}
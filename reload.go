@@ -0,0 +1,151 @@
+package moresql
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadTimeout bounds how long a reload waits for Read to take it,
+// Read may be blocked on full fans
+const reloadTimeout = time.Duration(30) * time.Second
+
+// ConfigDiff is the db.collection namespaces a reload adds,
+// removes or changes the mapping of
+type ConfigDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
+// DiffConfig compares the collections of two configs
+func DiffConfig(previous Config, next Config) ConfigDiff {
+	diff := ConfigDiff{Added: []string{}, Removed: []string{}, Changed: []string{}}
+	for dbName, db := range next {
+		for name, c := range db.Collections {
+			old, ok := previous[dbName].Collections[name]
+			switch {
+			case !ok:
+				diff.Added = append(diff.Added, dbName+"."+name)
+			case !reflect.DeepEqual(old, c):
+				diff.Changed = append(diff.Changed, dbName+"."+name)
+			}
+		}
+	}
+	for dbName, db := range previous {
+		for name := range db.Collections {
+			if _, ok := next[dbName].Collections[name]; !ok {
+				diff.Removed = append(diff.Removed, dbName+"."+name)
+			}
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+	return diff
+}
+
+// Empty reports whether the configs had the same collections
+func (d ConfigDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// restartsTail reports whether the mongo tail must be restarted for the
+// diff: when the namespaces change, or a change stream pipeline might
+func (d ConfigDiff) restartsTail(tailType string) bool {
+	return len(d.Added) > 0 || len(d.Removed) > 0 || (tailType == changeStream && len(d.Changed) > 0)
+}
+
+type reloadRequest struct {
+	config Config
+	done   chan ConfigDiff
+}
+
+// ReloadConfigFile reads the config file at path and reloads it,
+// the running config is kept when the file can't be read
+func (t *Tailer) ReloadConfigFile(path string) (ConfigDiff, error) {
+	config, err := LoadConfig(path)
+	if err != nil {
+		return ConfigDiff{}, err
+	}
+	return t.Reload(config)
+}
+
+// Reload hands config to Read, which swaps it in between two ops
+func (t *Tailer) Reload(config Config) (ConfigDiff, error) {
+	if atomic.LoadInt32(&t.serving) == 0 {
+		return ConfigDiff{}, fmt.Errorf("tailer is not serving")
+	}
+	req := reloadRequest{config: config, done: make(chan ConfigDiff, 1)}
+	select {
+	case t.reloads <- req:
+	case <-time.After(reloadTimeout):
+		return ConfigDiff{}, fmt.Errorf("reading from mongo did not take the reload within %s", reloadTimeout)
+	}
+	return <-req.done, nil
+}
+
+// applyConfig swaps in config, it is run by Read so no op is dispatched
+// meanwhile. Added collections get fans and workers. Removed ones stop
+// receiving ops, their workers retire once the ops sent are processed.
+// Ops already sent keep the mapping they were read with.
+func (t *Tailer) applyConfig(config Config) ConfigDiff {
+	diff := DiffConfig(t.config, config)
+	current, currentGates := t.fans()
+	fan := make(map[string]chan Op)
+	gates := make(map[string]*fanGate)
+	for k, c := range current {
+		fan[k] = c
+		gates[k] = currentGates[k]
+	}
+
+	added := make(map[string]chan Op)
+	for _, ns := range diff.Added {
+		for _, key := range t.fanKeys(ns) {
+			added[key] = make(chan Op, fanBufferSize)
+			fan[key] = added[key]
+		}
+	}
+	for k, gate := range t.startDedicatedConsumers(added, t.overflow) {
+		gates[k] = gate
+	}
+	retired := []chan Op{}
+	for _, ns := range diff.Removed {
+		for _, key := range t.fanKeys(ns) {
+			if c, ok := fan[key]; ok {
+				retired = append(retired, c)
+			}
+			if gate, ok := gates[key]; ok {
+				// A full gate's broker only waits for a resume
+				gate.Resume()
+			}
+			delete(fan, key)
+			delete(gates, key)
+		}
+	}
+
+	t.mu.Lock()
+	t.config, t.fan, t.gates = config, fan, gates
+	t.mu.Unlock()
+	// Only Read sends to the fans, none of these is written to again
+	for _, c := range retired {
+		close(c)
+	}
+	log.WithFields(log.Fields{"added": diff.Added, "removed": diff.Removed, "changed": diff.Changed}).Info("Reloaded config")
+	return diff
+}
+
+// fanKeys are the fan keys of namespace for every export
+func (t *Tailer) fanKeys(namespace string) []string {
+	parts := strings.SplitN(namespace, ".", 2)
+	keys := []string{}
+	for _, export := range strings.Split(t.env.exports, ",") {
+		keys = append(keys, createFanKey(parts[0], parts[1], export))
+	}
+	return keys
+}
@@ -0,0 +1,180 @@
+package moresql
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// RetryPolicy retries a write that failed with a transient error, waiting
+// BaseDelay * 2^attempt (capped at MaxDelay) between attempts. Jitter is
+// the fraction of each delay that is randomized so that workers failing
+// together don't retry in lockstep.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Jitter      float64
+	// Retryable classifies errors, IsRetryable when nil
+	Retryable func(err error) bool
+}
+
+// NewRetryPolicy builds the policy configured by the -retry-* flags
+func NewRetryPolicy(env Env) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: env.retryMaxAttempts,
+		BaseDelay:   env.retryBaseDelay,
+		MaxDelay:    env.retryMaxDelay,
+		Jitter:      env.retryJitter,
+	}
+}
+
+// Do calls fn until it succeeds, fails with an error that isn't
+// retryable, MaxAttempts is reached or ctx is done, returning the
+// last error
+func (p RetryPolicy) Do(ctx context.Context, fn func() error) error {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt+1 >= p.MaxAttempts || !retryable(err) {
+			return err
+		}
+		delay := p.Delay(attempt)
+		log.WithFields(log.Fields{"error": err, "attempt": attempt + 1, "delay": delay}).Warn("Retrying write")
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// Delay is the wait after the given zero based attempt failed
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 0; i < attempt && (p.MaxDelay <= 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 && delay > 0 {
+		spread := float64(delay) * p.Jitter
+		delay = time.Duration(float64(delay) - spread + rand.Float64()*2*spread)
+	}
+	return delay
+}
+
+// retryablePgCodes are the postgres errors worth retrying as the
+// same statement may succeed once the server or lock contention recovers
+var retryablePgCodes = map[pq.ErrorCode]bool{
+	"40001": true, // serialization_failure
+	"40P01": true, // deadlock_detected
+	"53300": true, // too_many_connections
+	"55P03": true, // lock_not_available
+	"57P01": true, // admin_shutdown
+	"57P02": true, // crash_shutdown
+	"57P03": true, // cannot_connect_now
+}
+
+// retryableMongoCodes are the server codes of network,
+// shutdown, failover and write concern timeout errors
+var retryableMongoCodes = map[int]bool{
+	6:     true, // HostUnreachable
+	7:     true, // HostNotFound
+	64:    true, // WriteConcernFailed
+	89:    true, // NetworkTimeout
+	91:    true, // ShutdownInProgress
+	189:   true, // PrimarySteppedDown
+	262:   true, // ExceededTimeLimit
+	9001:  true, // SocketException
+	10107: true, // NotMaster
+	11600: true, // InterruptedAtShutdown
+	11602: true, // InterruptedDueToReplStateChange
+	13435: true, // NotMasterNoSlaveOk
+	13436: true, // NotMasterOrSecondary
+}
+
+// IsRetryable reports whether err is a transient postgres or mongo error
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	if isMongoNetworkError(err) || isMongoTimeout(err) {
+		return true
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		// Class 08 is connection_exception
+		return retryablePgCodes[pqErr.Code] || pqErr.Code.Class() == "08"
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr.HasErrorLabel("RetryableWriteError") ||
+			cmdErr.HasErrorLabel("TransientTransactionError") ||
+			retryableMongoCodes[int(cmdErr.Code)]
+	}
+	var writeErr mongo.WriteException
+	if errors.As(err, &writeErr) {
+		if writeErr.WriteConcernError != nil && retryableMongoCodes[writeErr.WriteConcernError.Code] {
+			return true
+		}
+		for _, we := range writeErr.WriteErrors {
+			if retryableMongoCodes[we.Code] {
+				return true
+			}
+		}
+		return false
+	}
+	// pq reports a dropped connection with a plain error
+	return strings.Contains(err.Error(), "connection reset by peer")
+}
+
+// isMongoNetworkError and isMongoTimeout stand in for mongo.IsNetworkError
+// and mongo.IsTimeout, which the mongo-driver release in go.mod predates.
+// They follow the same rules: the NetworkError label for the former, a
+// deadline or a timeout code or label for the latter.
+func isMongoNetworkError(err error) bool {
+	var labeled interface{ HasErrorLabel(string) bool }
+	return errors.As(err, &labeled) && labeled.HasErrorLabel("NetworkError")
+}
+
+func isMongoTimeout(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) {
+		// 50 is MaxTimeMSExpired
+		return cmdErr.Code == 50 || cmdErr.Code == 89 || cmdErr.Code == 262 || cmdErr.HasErrorLabel("NetworkTimeoutError")
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package moresql_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/lib/pq"
+	m "github.com/zph/moresql"
+	"go.mongodb.org/mongo-driver/mongo"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestRetryPolicyDo(c *C) {
+	p := m.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+	deadlock := &pq.Error{Code: "40P01"}
+
+	calls := 0
+	err := p.Do(context.Background(), func() error {
+		calls++
+		return deadlock
+	})
+	c.Check(err, Equals, deadlock)
+	c.Check(calls, Equals, 3)
+
+	calls = 0
+	err = p.Do(context.Background(), func() error {
+		calls++
+		if calls < 2 {
+			return deadlock
+		}
+		return nil
+	})
+	c.Check(err, IsNil)
+	c.Check(calls, Equals, 2)
+
+	calls = 0
+	unique := &pq.Error{Code: "23505"}
+	err = p.Do(context.Background(), func() error {
+		calls++
+		return unique
+	})
+	c.Check(err, Equals, unique)
+	c.Check(calls, Equals, 1)
+}
+
+func (s *MySuite) TestRetryPolicyDelay(c *C) {
+	p := m.RetryPolicy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	c.Check(p.Delay(0), Equals, 100*time.Millisecond)
+	c.Check(p.Delay(2), Equals, 400*time.Millisecond)
+	c.Check(p.Delay(10), Equals, time.Second)
+
+	p.Jitter = 0.5
+	for i := 0; i < 20; i++ {
+		d := p.Delay(1)
+		c.Check(d >= 100*time.Millisecond && d <= 300*time.Millisecond, Equals, true)
+	}
+}
+
+func (s *MySuite) TestIsRetryable(c *C) {
+	c.Check(m.IsRetryable(&pq.Error{Code: "40001"}), Equals, true)
+	c.Check(m.IsRetryable(&pq.Error{Code: "57P01"}), Equals, true)
+	c.Check(m.IsRetryable(&pq.Error{Code: "08006"}), Equals, true)
+	c.Check(m.IsRetryable(&pq.Error{Code: "42P01"}), Equals, false)
+	c.Check(m.IsRetryable(mongo.CommandError{Labels: []string{"NetworkError"}}), Equals, true)
+	c.Check(m.IsRetryable(mongo.WriteException{WriteConcernError: &mongo.WriteConcernError{Code: 64}}), Equals, true)
+	c.Check(m.IsRetryable(mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000}}}), Equals, false)
+	c.Check(m.IsRetryable(errors.New("boom")), Equals, false)
+}
+
+func (s *MySuite) TestRetryPolicyDoStopsWhenCancelled(c *C) {
+	p := m.RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	deadlock := &pq.Error{Code: "40P01"}
+	calls := 0
+	err := p.Do(ctx, func() error {
+		calls++
+		cancel()
+		return deadlock
+	})
+	c.Check(err, Equals, deadlock)
+	c.Check(calls, Equals, 1)
+}
+
+func (s *MySuite) TestIsRetryableWrapped(c *C) {
+	c.Check(m.IsRetryable(fmt.Errorf("writing: %w", context.DeadlineExceeded)), Equals, true)
+	c.Check(m.IsRetryable(fmt.Errorf("writing: %w", io.ErrUnexpectedEOF)), Equals, true)
+	c.Check(m.IsRetryable(fmt.Errorf("writing: %w", mongo.CommandError{Labels: []string{"NetworkError"}})), Equals, true)
+	c.Check(m.IsRetryable(mongo.CommandError{Code: 50}), Equals, true)
+	c.Check(m.IsRetryable(fmt.Errorf("writing: %w", errors.New("boom"))), Equals, false)
+}
@@ -0,0 +1,105 @@
+package moresql
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"sync"
+
+	"github.com/serialx/hashring"
+)
+
+// laneBufferSize is the capacity of each worker lane
+const laneBufferSize = 100
+
+// KeyedRouter picks the worker lane for every op of a fan so that ops
+// sharing a key (the document _id) are processed in the order Read
+// received them. Lanes [0, dedicated) belong to the fan, the following
+// overflow lanes are shared by all fans and each lane has one consumer.
+//
+// While a key has ops in flight it sticks to the lane holding them. A key
+// with nothing in flight goes to its dedicated lane, or to an overflow
+// lane when the dedicated one holds more than workerCount ops.
+type KeyedRouter struct {
+	mu        sync.Mutex
+	name      string
+	ring      *hashring.HashRing
+	dedicated int
+	overflow  int
+	depth     func(lane int) int
+	inflight  map[string]*laneClaim
+}
+
+type laneClaim struct {
+	lane  int
+	count int
+}
+
+// NewKeyedRouter builds a router for the fan name. depth reports
+// how many ops are currently queued in a lane.
+func NewKeyedRouter(name string, dedicated int, overflow int, depth func(lane int) int) *KeyedRouter {
+	keys := []string{}
+	for i := 0; i < dedicated; i++ {
+		keys = append(keys, strconv.Itoa(i))
+	}
+	return &KeyedRouter{
+		name:      name,
+		ring:      hashring.New(keys),
+		dedicated: dedicated,
+		overflow:  overflow,
+		depth:     depth,
+		inflight:  make(map[string]*laneClaim),
+	}
+}
+
+// Acquire returns the lane for the next op of key. Every
+// Acquire must be followed by a Release once the op is done.
+func (r *KeyedRouter) Acquire(key string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	claim, ok := r.inflight[key]
+	if !ok {
+		lane := r.dedicatedLane(key)
+		if r.overflow > 0 && r.depth(lane) > workerCount {
+			lane = r.overflowLane(key)
+		}
+		claim = &laneClaim{lane: lane}
+		r.inflight[key] = claim
+	}
+	claim.count++
+	return claim.lane
+}
+
+// Release marks one op of key as processed
+func (r *KeyedRouter) Release(key string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	claim, ok := r.inflight[key]
+	if !ok {
+		return
+	}
+	claim.count--
+	if claim.count <= 0 {
+		delete(r.inflight, key)
+	}
+}
+
+func (r *KeyedRouter) dedicatedLane(key string) int {
+	node, ok := r.ring.GetNode(key)
+	if !ok {
+		return 0
+	}
+	lane, _ := strconv.Atoi(node)
+	return lane
+}
+
+func (r *KeyedRouter) overflowLane(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(r.name))
+	h.Write([]byte(key))
+	return r.dedicated + int(h.Sum32()%uint32(r.overflow))
+}
+
+func routerKey(op Op) string {
+	return fmt.Sprintf("%v", op.data.Id)
+}
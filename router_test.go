@@ -0,0 +1,92 @@
+package moresql_test
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+)
+
+type routedOp struct {
+	key string
+	seq int
+}
+
+func (s *MySuite) TestKeyedRouterStickyLane(c *C) {
+	depth := 0
+	router := m.NewKeyedRouter("db.coll.postgres", 2, 4, func(lane int) int { return depth })
+	first := router.Acquire("a")
+	c.Check(first < 2, Equals, true)
+
+	// Backed up dedicated lanes must not move a key with ops in flight
+	depth = 100
+	c.Check(router.Acquire("a"), Equals, first)
+	router.Release("a")
+	router.Release("a")
+
+	// Nothing in flight anymore, the key may now overflow
+	c.Check(router.Acquire("a") >= 2, Equals, true)
+	router.Release("a")
+}
+
+// TestKeyedRouterOrderingUnderLoad pushes many updates per key through slow
+// dedicated lanes and fast overflow lanes and checks that every key is
+// still processed in the order it was produced.
+func (s *MySuite) TestKeyedRouterOrderingUnderLoad(c *C) {
+	const dedicated, overflow, keys, updates = 2, 16, 50, 40
+	lanes := []chan routedOp{}
+	for i := 0; i < dedicated+overflow; i++ {
+		lanes = append(lanes, make(chan routedOp, 100))
+	}
+	router := m.NewKeyedRouter("db.coll.postgres", dedicated, overflow, func(lane int) int { return len(lanes[lane]) })
+
+	var mu sync.Mutex
+	last := make(map[string]int)
+	outOfOrder := 0
+	overflowed := 0
+	var done sync.WaitGroup
+	done.Add(keys * updates)
+	for i, lane := range lanes {
+		go func(i int, lane chan routedOp) {
+			for op := range lane {
+				delay := time.Duration(rand.Intn(50)) * time.Microsecond
+				if i < dedicated {
+					// Slow dedicated workers force ops into overflow
+					delay = delay * 10
+				}
+				time.Sleep(delay)
+				mu.Lock()
+				if op.seq <= last[op.key] {
+					outOfOrder++
+				}
+				last[op.key] = op.seq
+				if i >= dedicated {
+					overflowed++
+				}
+				mu.Unlock()
+				router.Release(op.key)
+				done.Done()
+			}
+		}(i, lane)
+	}
+
+	for seq := 1; seq <= updates; seq++ {
+		for k := 0; k < keys; k++ {
+			key := fmt.Sprintf("id-%d", k)
+			lanes[router.Acquire(key)] <- routedOp{key, seq}
+		}
+	}
+	done.Wait()
+	for _, lane := range lanes {
+		close(lane)
+	}
+
+	c.Check(outOfOrder, Equals, 0)
+	c.Check(overflowed > 0, Equals, true)
+	for k := 0; k < keys; k++ {
+		c.Check(last[fmt.Sprintf("id-%d", k)], Equals, updates)
+	}
+}
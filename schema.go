@@ -0,0 +1,376 @@
+package moresql
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+)
+
+// PlanSchema compares the configured collections with postgres and
+// returns, in the order they must be run, the changes needed to create
+// missing schemas, tables, columns and unique indexes on the id column.
+// Nothing is planned for the collections unless exports has postgres.
+// withMetadata also plans the moresql_metadata table used by -checkpoint.
+func (c *Commands) PlanSchema(config Config, exports []string, pg *sqlx.DB, withMetadata bool) ([]TableColumn, error) {
+	q := Queries{}
+	changes := []TableColumn{}
+	schemas := make(map[string]bool)
+	tables := make(map[string]bool)
+	for _, coll := range schemaCollections(config, exports) {
+		schema := coll.Schema
+		table := coll.Name
+		// Collections of several dbs may share a table
+		if tables[coll.pgTableQuoted()] {
+			continue
+		}
+		tables[coll.pgTableQuoted()] = true
+		if _, ok := schemas[schema]; !ok {
+			exists, err := countExists(pg, q.SchemaExists(), schema)
+			if err != nil {
+				return nil, err
+			}
+			schemas[schema] = exists
+			if !exists {
+				t := TableColumn{Schema: schema, Message: "Missing Schema"}
+				t.Solution = t.createSchema()
+				changes = append(changes, t)
+			}
+		}
+
+		o := Statement{coll}
+		id := o.id().Export.Name
+		exists := false
+		if schemas[schema] {
+			var err error
+			if exists, err = countExists(pg, q.TableExists(), schema, table); err != nil {
+				return nil, err
+			}
+		}
+		if !exists {
+			changes = append(changes, TableColumn{Schema: schema, Table: table, Message: "Missing Table", Solution: o.BuildCreateTable()})
+			t := TableColumn{Schema: schema, Table: table, Column: id, Message: "Missing Unique Index on Column"}
+			t.Solution = t.uniqueIndex()
+			changes = append(changes, t)
+			continue
+		}
+
+		columns, err := tableColumns(pg, schema, table)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range o.sortedKeys() {
+			field := coll.Fields[k]
+			if _, ok := columns[field.Export.Name]; !ok {
+				t := TableColumn{Schema: schema, Table: table, Column: field.Export.Name, Message: "Missing Column", Type: field.Export.Type}
+				t.Solution = t.createColumn()
+				changes = append(changes, t)
+			}
+		}
+		if len(coll.ExtraProps) > 0 {
+			if _, ok := columns["_extra_props"]; !ok {
+				t := TableColumn{Schema: schema, Table: table, Column: "_extra_props", Message: "Missing Column", Type: coll.ExtraProps}
+				t.Solution = t.createColumn()
+				changes = append(changes, t)
+			}
+		}
+
+		r := hasUniqueIndex{}
+		if err := pg.Get(&r, q.GetTableColumnIndexMetadata(), schema, table, id); err != nil {
+			return nil, err
+		}
+		if !r.isValid() {
+			t := TableColumn{Schema: schema, Table: table, Column: id, Message: "Missing Unique Index on Column"}
+			t.Solution = t.uniqueIndex()
+			changes = append(changes, t)
+		}
+	}
+
+	if withMetadata {
+		metadata, err := c.planMetadata(pg)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, metadata...)
+	}
+	return changes, nil
+}
+
+func (c *Commands) planMetadata(pg *sqlx.DB) ([]TableColumn, error) {
+	q := Queries{}
+	exists, err := countExists(pg, q.TableExists(), "public", "moresql_metadata")
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return []TableColumn{{
+			Schema:   "public",
+			Table:    "moresql_metadata",
+			Message:  "Missing Table",
+			Solution: q.CreateMetadataTableIfNotExists(),
+		}}, nil
+	}
+	columns, err := tableColumns(pg, "public", "moresql_metadata")
+	if err != nil {
+		return nil, err
+	}
+	return missingMetadataColumns(columns), nil
+}
+
+// missingMetadataColumns are the metadataMigrations
+// absent from the moresql_metadata columns
+func missingMetadataColumns(columns map[string]ColumnResult) []TableColumn {
+	changes := []TableColumn{}
+	for _, t := range metadataMigrations {
+		if _, ok := columns[t.Column]; !ok {
+			t.Message = "Missing Column"
+			t.Solution = t.addColumnIfNotExists()
+			changes = append(changes, t)
+		}
+	}
+	return changes
+}
+
+// MigrateMetadata adds the columns introduced after the first release
+// to the moresql_metadata table used by -checkpoint, checkpoints can't
+// be saved to a table created by an earlier release without them
+func MigrateMetadata(pg *sqlx.DB) error {
+	columns, err := tableColumns(pg, "public", "moresql_metadata")
+	if err != nil {
+		return fmt.Errorf("reading the columns of moresql_metadata: %s", err)
+	}
+	if len(columns) == 0 {
+		return fmt.Errorf("moresql_metadata is missing, create it with -apply-schema or the SQL of -create-table-sql")
+	}
+	for _, t := range missingMetadataColumns(columns) {
+		log.WithFields(log.Fields{"column": t.Column}).Info("Adding missing column to moresql_metadata")
+		if _, err := pg.Exec(t.Solution); err != nil {
+			return fmt.Errorf("adding %s to moresql_metadata: %s", t.Column, err)
+		}
+	}
+	return nil
+}
+
+// PlanColumnTypes compares the columns of the configured tables that
+// already exist with the export types of the config. Columns whose type
+// differs get an ALTER COLUMN ... TYPE ... USING, and columns other than
+// the id that are NOT NULL get a DROP NOT NULL as documents missing the
+// field are written as NULL. These changes can rewrite data so they are
+// reported by -validate but never run by -apply-schema.
+func (c *Commands) PlanColumnTypes(config Config, exports []string, pg *sqlx.DB) ([]TableColumn, error) {
+	changes := []TableColumn{}
+	tables := make(map[string]bool)
+	for _, coll := range schemaCollections(config, exports) {
+		if tables[coll.pgTableQuoted()] {
+			continue
+		}
+		tables[coll.pgTableQuoted()] = true
+		columns, err := tableColumns(pg, coll.Schema, coll.Name)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, columnTypeChanges(coll, columns)...)
+	}
+	return changes, nil
+}
+
+// columnTypeChanges compares the existing columns of coll's table
+// with the export type and nullability the config expects
+func columnTypeChanges(coll Collection, columns map[string]ColumnResult) []TableColumn {
+	changes := []TableColumn{}
+	o := Statement{coll}
+	expected := []Export{}
+	for _, k := range o.sortedKeys() {
+		expected = append(expected, coll.Fields[k].Export)
+	}
+	if len(coll.ExtraProps) > 0 {
+		expected = append(expected, Export{Name: "_extra_props", Type: coll.ExtraProps})
+	}
+	for _, export := range expected {
+		column, ok := columns[export.Name]
+		if !ok {
+			continue
+		}
+		t := TableColumn{Schema: coll.Schema, Table: coll.Name, Column: export.Name, Type: export.Type}
+		if len(export.Type) > 0 && !PgTypesEqual(export.Type, column.UdtName) {
+			t.Message = fmt.Sprintf("Column Type %s Expected %s", column.DataType, export.Type)
+			t.Solution = t.alterColumnType()
+			changes = append(changes, t)
+		}
+		if export.Name != o.id().Export.Name && !column.isNullable() {
+			t.Message = "Column Not Nullable"
+			t.Solution = t.dropNotNull()
+			changes = append(changes, t)
+		}
+	}
+	return changes
+}
+
+// pgTypeAliases maps the spellings postgres accepts for
+// a type to the udt_name reported by information_schema
+var pgTypeAliases = map[string]string{
+	"bigint":                      "int8",
+	"bigserial":                   "int8",
+	"serial8":                     "int8",
+	"integer":                     "int4",
+	"int":                         "int4",
+	"serial":                      "int4",
+	"serial4":                     "int4",
+	"smallint":                    "int2",
+	"smallserial":                 "int2",
+	"serial2":                     "int2",
+	"double precision":            "float8",
+	"float":                       "float8",
+	"real":                        "float4",
+	"decimal":                     "numeric",
+	"boolean":                     "bool",
+	"character varying":           "varchar",
+	"character":                   "bpchar",
+	"char":                        "bpchar",
+	"timestamp":                   "timestamp",
+	"timestamp without time zone": "timestamp",
+	"timestamp with time zone":    "timestamptz",
+	"time without time zone":      "time",
+	"time with time zone":         "timetz",
+	"bit varying":                 "varbit",
+}
+
+// NormalizePgType reduces a type as written in the config or reported
+// by postgres to its udt_name, ie DOUBLE PRECISION and float8 are both
+// float8, VARCHAR(255) is varchar and TEXT[] is _text
+func NormalizePgType(t string) string {
+	t = strings.ToLower(strings.TrimSpace(t))
+	if strings.HasSuffix(t, "[]") {
+		return "_" + NormalizePgType(strings.TrimSuffix(t, "[]"))
+	}
+	// Drop modifiers such as (255) or (10,2), keeping any trailing words
+	// so that timestamp(3) with time zone stays timestamptz
+	if i := strings.Index(t, "("); i >= 0 {
+		if j := strings.Index(t[i:], ")"); j >= 0 {
+			t = t[:i] + t[i+j+1:]
+		}
+	}
+	t = strings.Join(strings.Fields(t), " ")
+	if alias, ok := pgTypeAliases[t]; ok {
+		return alias
+	}
+	return t
+}
+
+// PgTypesEqual reports whether two type spellings name the same postgres type
+func PgTypesEqual(a string, b string) bool {
+	return NormalizePgType(a) == NormalizePgType(b)
+}
+
+// ApplySchema runs the changes from PlanSchema in a single transaction
+// so a failure leaves postgres untouched
+func (c *Commands) ApplySchema(changes []TableColumn, pg *sqlx.DB) error {
+	tx, err := pg.Beginx()
+	if err != nil {
+		return err
+	}
+	for _, t := range changes {
+		log.WithFields(log.Fields{"schema": t.Schema, "table": t.Table, "column": t.Column}).Info(t.Message)
+		if _, err := tx.Exec(t.Solution); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("%s: %s", t.Solution, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Schema prints the plan for the configured tables and the checkpoint
+// table and applies it when apply is set
+func (c *Commands) Schema(config Config, exports []string, pg *sqlx.DB, apply bool) error {
+	changes, err := c.PlanSchema(config, exports, pg, true)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		log.Printf("Postgres tables are up to date.")
+		return nil
+	}
+	for _, v := range changes {
+		fmt.Printf("-- %s %s.%s %s\n%s\n", v.Message, v.Schema, v.Table, v.Column, v.Solution)
+	}
+	if !apply {
+		return nil
+	}
+	if err := c.ApplySchema(changes, pg); err != nil {
+		return err
+	}
+	log.Printf("Applied %d schema changes.", len(changes))
+	return nil
+}
+
+type countResult struct {
+	Value int `db:"count"`
+}
+
+func countExists(pg *sqlx.DB, query string, args ...interface{}) (bool, error) {
+	r := countResult{}
+	if err := pg.Get(&r, query, args...); err != nil {
+		return false, err
+	}
+	return r.Value > 0, nil
+}
+
+func tableColumns(pg *sqlx.DB, schema string, table string) (map[string]ColumnResult, error) {
+	q := Queries{}
+	rows, err := pg.NamedQuery(q.GetColumnsFromTable(), map[string]interface{}{"schema": schema, "table": table})
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns := make(map[string]ColumnResult)
+	for rows.Next() {
+		var row ColumnResult
+		if err := rows.StructScan(&row); err != nil {
+			return nil, err
+		}
+		columns[row.Name] = row
+	}
+	return columns, rows.Err()
+}
+
+// schemaCollections are the collections written to postgres tables,
+// none unless exports has postgres. Collections without a mapping for
+// _id are skipped as their ops are never written.
+func schemaCollections(config Config, exports []string) []Collection {
+	colls := []Collection{}
+	if !HasTypeExport(exports, postgresExport) {
+		return colls
+	}
+	for _, coll := range sortedCollections(config) {
+		if len(coll.Fields["_id"].Export.Name) == 0 {
+			log.WithField("table", coll.pgTableQuoted()).Warn("Skipping table without a field for _id")
+			continue
+		}
+		colls = append(colls, coll)
+	}
+	return colls
+}
+
+// sortedCollections orders the collections of config by db
+// and collection name so plans are stable between runs
+func sortedCollections(config Config) []Collection {
+	dbs := []string{}
+	for k := range config {
+		dbs = append(dbs, k)
+	}
+	sort.Strings(dbs)
+	colls := []Collection{}
+	for _, db := range dbs {
+		names := []string{}
+		for k := range config[db].Collections {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			colls = append(colls, config[db].Collections[name])
+		}
+	}
+	return colls
+}
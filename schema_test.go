@@ -0,0 +1,113 @@
+package moresql_test
+
+import (
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestNormalizePgType(c *C) {
+	tests := []struct {
+		in       string
+		expected string
+	}{
+		{"DOUBLE PRECISION", "float8"},
+		{"float8", "float8"},
+		{"JSONB", "jsonb"},
+		{"TEXT", "text"},
+		{"TIMESTAMP", "timestamp"},
+		{"timestamp without time zone", "timestamp"},
+		{"TIMESTAMP WITH TIME ZONE", "timestamptz"},
+		{"timestamp(3) with time zone", "timestamptz"},
+		{"VARCHAR(255)", "varchar"},
+		{"numeric(10,2)", "numeric"},
+		{"INTEGER", "int4"},
+		{"text[]", "_text"},
+	}
+	for _, t := range tests {
+		c.Check(m.NormalizePgType(t.in), Equals, t.expected, Commentf("%s", t.in))
+	}
+	c.Check(m.PgTypesEqual("BIGINT", "int8"), Equals, true)
+	c.Check(m.PgTypesEqual("TEXT", "jsonb"), Equals, false)
+}
+
+func (s *MySuite) TestPlanSchemaSkipsUnwrittenCollections(c *C) {
+	cmd := m.Commands{}
+	config := m.Config{"app": m.DB{Collections: m.Collections{
+		"users":  m.Collection{Name: "users", Schema: "public", Fields: m.Fields{"_id": BuildFieldFromId("_id")}},
+		"mirror": m.Collection{Name: "mirror", Schema: "public", AllField: true},
+	}}}
+	// Without postgres in exports nothing is planned, postgres is never queried
+	changes, err := cmd.PlanSchema(config, []string{"csv"}, nil, false)
+	c.Check(err, IsNil)
+	c.Check(changes, HasLen, 0)
+
+	// Collections without a field for _id are skipped
+	delete(config["app"].Collections, "users")
+	changes, err = cmd.PlanSchema(config, []string{"postgres"}, nil, false)
+	c.Check(err, IsNil)
+	c.Check(changes, HasLen, 0)
+}
+
+func (s *MySuite) TestColumnTypeChanges(c *C) {
+	coll := m.Collection{
+		Name:   "Orders",
+		Schema: "public",
+		Fields: m.Fields{
+			"_id":   m.Field{Mongo: m.Mongo{Name: "_id", Type: "id"}, Export: m.Export{Name: "id", Type: "TEXT"}},
+			"total": m.Field{Mongo: m.Mongo{Name: "total", Type: "float"}, Export: m.Export{Name: "Total", Type: "DOUBLE PRECISION"}},
+			"user":  m.Field{Mongo: m.Mongo{Name: "user", Type: "text"}, Export: m.Export{Name: "user", Type: "TEXT"}},
+			"note":  m.Field{Mongo: m.Mongo{Name: "note", Type: "text"}, Export: m.Export{Name: "note", Type: "TEXT"}},
+		},
+	}
+	columns := map[string]m.ColumnResult{
+		"id":    {Name: "id", DataType: "text", UdtName: "text", Nullable: "NO"},
+		"Total": {Name: "Total", DataType: "integer", UdtName: "int4", Nullable: "YES"},
+		"user":  {Name: "user", DataType: "text", UdtName: "text", Nullable: "NO"},
+		"note":  {Name: "note", DataType: "character varying", UdtName: "varchar", Nullable: "YES"},
+	}
+	changes := m.ColumnTypeChanges(coll, columns)
+	c.Assert(changes, HasLen, 3)
+
+	c.Check(changes[0].Column, Equals, "note")
+	c.Check(changes[0].Message, Equals, "Column Type character varying Expected TEXT")
+
+	c.Check(changes[1].Column, Equals, "Total")
+	c.Check(changes[1].Message, Equals, "Column Type integer Expected DOUBLE PRECISION")
+	c.Check(changes[1].Solution, Equals, `ALTER TABLE public."Orders" ALTER COLUMN "Total" TYPE DOUBLE PRECISION USING "Total"::DOUBLE PRECISION;`)
+
+	// The id may be NOT NULL, other columns may not
+	c.Check(changes[2].Column, Equals, "user")
+	c.Check(changes[2].Message, Equals, "Column Not Nullable")
+	c.Check(changes[2].Solution, Equals, `ALTER TABLE public."Orders" ALTER COLUMN "user" DROP NOT NULL;`)
+}
+
+func (s *MySuite) TestMissingMetadataColumns(c *C) {
+	columns := map[string]m.ColumnResult{
+		"app_name":     {Name: "app_name"},
+		"last_epoch":   {Name: "last_epoch"},
+		"processed_at": {Name: "processed_at"},
+	}
+	changes := m.MissingMetadataColumns(columns)
+	c.Assert(changes, HasLen, 2)
+	c.Check(changes[0].Column, Equals, "last_ordinal")
+	c.Check(changes[0].Solution, Equals, `ALTER TABLE public."moresql_metadata" ADD COLUMN IF NOT EXISTS "last_ordinal" INT DEFAULT 0 NOT NULL;`)
+	c.Check(changes[1].Column, Equals, "resume_tokens")
+
+	// A migrated table needs nothing
+	columns["last_ordinal"] = m.ColumnResult{Name: "last_ordinal"}
+	columns["resume_tokens"] = m.ColumnResult{Name: "resume_tokens"}
+	c.Check(m.MissingMetadataColumns(columns), HasLen, 0)
+}
+
+func (s *MySuite) TestSchemaDDLQuotesNames(c *C) {
+	t := m.TableColumn{Schema: "Sales", Table: "order", Column: "Total", Type: "DOUBLE PRECISION"}
+	c.Check(m.CreateColumn(&t), Equals, `ALTER TABLE Sales."order" ADD "Total" DOUBLE PRECISION NULL;`)
+	c.Check(m.CreateSchema(&t), Equals, `CREATE SCHEMA IF NOT EXISTS "sales";`)
+
+	t = m.TableColumn{Schema: "public", Table: "user", Column: "id"}
+	c.Check(m.UniqueIndex(&t), Equals, `CREATE UNIQUE INDEX "user_service_uindex_on_id" ON public."user" ("id");`)
+
+	// Dotted fields are written to underscored columns
+	t = m.TableColumn{Schema: "public", Table: "user", Column: "name.first", Type: "TEXT"}
+	c.Check(m.CreateColumn(&t), Equals, `ALTER TABLE public."user" ADD "name_first" TEXT NULL;`)
+}
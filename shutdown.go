@@ -0,0 +1,55 @@
+package moresql
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Shutdown stops reading from mongo, waits up to timeout for every
+// op already in the fan and overflow channels to be written, then
+// flushes the exporters and saves a final checkpoint. Ops still in
+// flight at the deadline are not checkpointed and replay on restart.
+// The exporters are flushed and closed even when the deadline passes.
+func (t *Tailer) Shutdown(timeout time.Duration) error {
+	deadline := time.After(timeout)
+	close(t.quit)
+
+	var err error
+	select {
+	case <-t.readDone:
+		err = t.drain(deadline, timeout)
+	case <-deadline:
+		err = fmt.Errorf("timed out after %s waiting for reader to stop", timeout)
+	}
+	if err != nil {
+		log.WithField("error", err).Warn("Saving checkpoint without draining")
+	}
+
+	if t.env.checkpoint {
+		if saveErr := t.SaveLatestCheckpoint(); saveErr != nil && err == nil {
+			err = saveErr
+		}
+	} else if flushErr := t.flushExporters(); flushErr != nil && err == nil {
+		err = flushErr
+	}
+	t.closeOutputs()
+	return err
+}
+
+// drain waits until every op handed to the workers is written
+func (t *Tailer) drain(deadline <-chan time.Time, timeout time.Duration) error {
+	drained := make(chan struct{})
+	go func() {
+		t.inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		log.Info("Drained in-flight operations")
+		return nil
+	case <-deadline:
+		return fmt.Errorf("timed out after %s draining in-flight operations", timeout)
+	}
+}
@@ -3,9 +3,9 @@ package moresql
 import (
 	"encoding/json"
 	"fmt"
-	"os"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -16,6 +16,8 @@ type DBResult struct {
 	MongoDB    string
 	Collection string
 	Data       map[string]interface{}
+	// pending is marked done once the writer handled Data
+	pending *sync.WaitGroup
 }
 
 type MongoResult struct {
@@ -35,6 +37,11 @@ type urls struct {
 type Env struct {
 	urls                  urls
 	sync                  bool
+	fullSyncOnly          string
+	fullSyncFilter        string
+	fullSyncParallelism   int
+	fullSyncPartitions    int
+	bootstrap             bool
 	syncFile              bool
 	syncFilePath          string
 	syncFileCollection    string
@@ -42,10 +49,16 @@ type Env struct {
 	tail                  bool
 	tailType              string
 	SSLCert               string
+	SSLClientCert         string
+	SSLClientKey          string
 	SSLInsecureSkipVerify bool
 	configFile            string
 	allowDeletes          bool
 	monitor               bool
+	monitorAddr           string
+	enableAdmin           bool
+	readyMaxIdle          time.Duration
+	readyMaxLag           time.Duration
 	replayOplog           bool
 	replayDuration        time.Duration
 	replaySecond          int64
@@ -53,6 +66,8 @@ type Env struct {
 	appName               string
 	createTableSQL        bool
 	validatePostgres      bool
+	planSchema            bool
+	applySchema           bool
 	reportingToken        string
 	appEnvironment        string
 	errorReporting        string
@@ -62,11 +77,22 @@ type Env struct {
 	csvPathFile           string
 	justInsert            bool
 	skipError             bool
+	batchSize             int
+	batchDuration         time.Duration
+	shutdownTimeout       time.Duration
+	deadLetters           string
+	replayDeadLetters     bool
+	retryMaxAttempts      int
+	retryBaseDelay        time.Duration
+	retryMaxDelay         time.Duration
+	retryJitter           float64
+	reconnectMaxAttempts  int
+	onStreamInvalidate    string
 }
 
 func (e *Env) UseSSL() (r bool) {
 	r = false
-	if e.SSLCert != "" || e.SSLInsecureSkipVerify {
+	if e.SSLCert != "" || e.SSLClientCert != "" || e.SSLInsecureSkipVerify {
 		r = true
 	}
 	return
@@ -82,10 +108,10 @@ func (q *Queries) GetMetadata() string {
 
 // SaveMetadata performs an upsert using metadata with uniqueness constraint on app_name
 func (q *Queries) SaveMetadata() string {
-	return `INSERT INTO "moresql_metadata" ("app_name", "last_epoch", "processed_at")
-VALUES (:app_name, :last_epoch, :processed_at)
+	return `INSERT INTO "moresql_metadata" ("app_name", "last_epoch", "last_ordinal", "resume_tokens", "processed_at")
+VALUES (:app_name, :last_epoch, :last_ordinal, :resume_tokens, :processed_at)
 ON CONFLICT ("app_name")
-DO UPDATE SET "last_epoch" = :last_epoch, "processed_at" = :processed_at;`
+DO UPDATE SET "last_epoch" = :last_epoch, "last_ordinal" = :last_ordinal, "resume_tokens" = :resume_tokens, "processed_at" = :processed_at;`
 }
 
 // CreateMetadataTable provides the sql required to setup the metadata table
@@ -96,6 +122,8 @@ CREATE TABLE public.moresql_metadata
 (
     app_name TEXT NOT NULL,
     last_epoch INT NOT NULL,
+    last_ordinal INT DEFAULT 0 NOT NULL,
+    resume_tokens JSONB DEFAULT '{}' NOT NULL,
     processed_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL
 );
 -- Setup mandatory unique index
@@ -106,6 +134,8 @@ GRANT SELECT, UPDATE, DELETE ON TABLE public.moresql_metadata TO $USERNAME;
 
 COMMENT ON COLUMN public.moresql_metadata.app_name IS 'Name of application. Used for circumstances where multiple apps stream to same PG instance.';
 COMMENT ON COLUMN public.moresql_metadata.last_epoch IS 'Most recent epoch processed from Mongo';
+COMMENT ON COLUMN public.moresql_metadata.last_ordinal IS 'Ordinal within last_epoch of the most recent op processed from Mongo';
+COMMENT ON COLUMN public.moresql_metadata.resume_tokens IS 'Most recent change stream resume token per namespace';
 COMMENT ON COLUMN public.moresql_metadata.processed_at IS 'Timestamp for when the last epoch was processed at';
 COMMENT ON TABLE public.moresql_metadata IS 'Stores checkpoint data for MoreSQL (mongo->pg) streaming';
 `
@@ -113,67 +143,148 @@ COMMENT ON TABLE public.moresql_metadata IS 'Stores checkpoint data for MoreSQL
 
 func (q *Queries) GetColumnsFromTable() string {
 	return `
-SELECT column_name
+SELECT column_name, data_type, udt_name, is_nullable
 FROM information_schema.columns
 WHERE table_schema = :schema
   AND table_name   = :table`
 }
 
+// GetTableColumnIndexMetadata counts the valid unique indexes, including
+// primary keys, of table $2 in schema $1 whose only key is column $3.
+// Partial and expression indexes are skipped as postgres cannot infer
+// them for the ON CONFLICT of Statement.BuildUpsert. INCLUDE columns
+// aren't keys, so only indnkeyatts (postgres 11+) is compared.
 func (q *Queries) GetTableColumnIndexMetadata() string {
 	return `
--- Get table, columns, and index metadata
-WITH tables_and_indexes AS (
-  -- CREDIT: http://stackoverflow.com/a/25596855
-    SELECT
-      c.relname                                       AS table,
-      f.attname                                       AS column,
-      pg_catalog.format_type(f.atttypid, f.atttypmod) AS type,
-      f.attnotnull                                    AS notnull,
-      i.relname                                       AS index_name,
-      CASE
-      WHEN i.oid <> 0
-        THEN TRUE
-      ELSE FALSE
-      END                                             AS is_index,
-      CASE
-      WHEN p.contype = 'p'
-        THEN TRUE
-      ELSE FALSE
-      END                                             AS primarykey,
-      CASE
-      WHEN p.contype = 'u'
-        THEN TRUE
-      WHEN p.contype = 'p'
-        THEN TRUE
-      ELSE FALSE
-      END                                             AS uniquekey,
-      CASE
-      WHEN f.atthasdef = 't'
-        THEN d.adsrc
-      END                                             AS default
-    FROM pg_attribute f
-      JOIN pg_class c ON c.oid = f.attrelid
-      JOIN pg_type t ON t.oid = f.atttypid
-      LEFT JOIN pg_attrdef d ON d.adrelid = c.oid AND d.adnum = f.attnum
-      LEFT JOIN pg_namespace n ON n.oid = c.relnamespace
-      LEFT JOIN pg_constraint p ON p.conrelid = c.oid AND f.attnum = ANY (p.conkey)
-      LEFT JOIN pg_class AS g ON p.confrelid = g.oid
-      LEFT JOIN pg_index AS ix ON f.attnum = ANY (ix.indkey) AND c.oid = f.attrelid AND c.oid = ix.indrelid
-      LEFT JOIN pg_class AS i ON ix.indexrelid = i.oid
-
-    WHERE c.relkind = 'r' :: CHAR
-          AND n.nspname = 'public'  -- Replace with Schema name
-          --AND c.relname = 'nodes'  -- Replace with table name, or Comment this for get all tables
-          AND f.attnum > 0
-    ORDER BY c.relname, f.attname
-)
-SELECT count(*) from tables_and_indexes
-WHERE "table" = $1
-AND "column" = $2
-AND is_index IS TRUE
--- TODO: determine how to check if index is unique vs unique column
--- AND uniquekey IS TRUE;
-	`
+SELECT count(*)
+FROM pg_catalog.pg_index ix
+  JOIN pg_catalog.pg_class c ON c.oid = ix.indrelid
+  JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+  JOIN pg_catalog.pg_attribute a ON a.attrelid = c.oid AND a.attnum = ix.indkey[0]
+WHERE n.nspname = $1
+  AND c.relname = $2
+  AND a.attname = $3
+  AND ix.indisunique
+  AND ix.indisvalid
+  AND ix.indnkeyatts = 1
+  AND ix.indpred IS NULL
+  AND ix.indexprs IS NULL;`
+}
+
+// metadataMigrations are the moresql_metadata columns added
+// after its first release, in the order they were introduced
+var metadataMigrations = []TableColumn{
+	{Schema: "public", Table: "moresql_metadata", Column: "last_ordinal", Type: "INT DEFAULT 0 NOT NULL"},
+	{Schema: "public", Table: "moresql_metadata", Column: "resume_tokens", Type: "JSONB DEFAULT '{}' NOT NULL"},
+}
+
+// MigrateMetadataTable adds the columns introduced after the first
+// release of moresql_metadata to an existing table
+func (q *Queries) MigrateMetadataTable() string {
+	sql := "\n-- upgrade an existing moresql_metadata table for exact checkpoints\n"
+	for _, t := range metadataMigrations {
+		sql += t.addColumnIfNotExists() + "\n"
+	}
+	return sql
+}
+
+// CreateMetadataTableIfNotExists is the DDL of CreateMetadataTable
+// without the grant and comments, as run by -apply-schema
+func (q *Queries) CreateMetadataTableIfNotExists() string {
+	return `CREATE TABLE IF NOT EXISTS public.moresql_metadata
+(
+    app_name TEXT NOT NULL,
+    last_epoch INT NOT NULL,
+    last_ordinal INT DEFAULT 0 NOT NULL,
+    resume_tokens JSONB DEFAULT '{}' NOT NULL,
+    processed_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL
+);
+CREATE UNIQUE INDEX IF NOT EXISTS moresql_metadata_app_name_uindex ON public.moresql_metadata (app_name);`
+}
+
+// CreateDeadLettersTable creates the table used by -dead-letters=postgres
+func (q *Queries) CreateDeadLettersTable() string {
+	return `CREATE TABLE IF NOT EXISTS public.moresql_dead_letters
+(
+    id BIGSERIAL PRIMARY KEY,
+    app_name TEXT NOT NULL,
+    namespace TEXT NOT NULL,
+    doc_id TEXT NOT NULL,
+    operation TEXT NOT NULL,
+    epoch INT NOT NULL,
+    ordinal INT NOT NULL,
+    payload JSONB NOT NULL,
+    export TEXT NOT NULL,
+    error TEXT NOT NULL,
+    failed_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL
+);`
+}
+
+func (q *Queries) SaveDeadLetter() string {
+	return `INSERT INTO "moresql_dead_letters" ("app_name", "namespace", "doc_id", "operation", "epoch", "ordinal", "payload", "export", "error", "failed_at")
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10);`
+}
+
+// GetDeadLetters fetches the dead letters of an appname, oldest first
+// GetDeadLetters pages through the dead letters of app $1
+// with an id above $2, at most $3 at a time
+func (q *Queries) GetDeadLetters() string {
+	return `SELECT * FROM moresql_dead_letters WHERE app_name=$1 AND id>$2 ORDER BY id LIMIT $3;`
+}
+
+func (q *Queries) DeleteDeadLetter() string {
+	return `DELETE FROM moresql_dead_letters WHERE id=$1;`
+}
+
+// CreateSyncProgressTable creates the table full sync
+// saves the progress of each partition in
+func (q *Queries) CreateSyncProgressTable() string {
+	return `CREATE TABLE IF NOT EXISTS public.moresql_sync_progress
+(
+    app_name TEXT NOT NULL,
+    namespace TEXT NOT NULL,
+    partition INT NOT NULL,
+    total INT NOT NULL,
+    bounds TEXT NOT NULL,
+    last_id TEXT DEFAULT '' NOT NULL,
+    doc_count BIGINT DEFAULT 0 NOT NULL,
+    state TEXT NOT NULL,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW() NOT NULL,
+    PRIMARY KEY (app_name, namespace, partition)
+);`
+}
+
+// GetSyncProgress fetches the partitions of namespace $2 for appname $1
+func (q *Queries) GetSyncProgress() string {
+	return `SELECT * FROM moresql_sync_progress WHERE app_name=$1 AND namespace=$2 ORDER BY partition;`
+}
+
+// SaveSyncProgress performs an upsert of a partition's progress
+func (q *Queries) SaveSyncProgress() string {
+	return `INSERT INTO "moresql_sync_progress" ("app_name", "namespace", "partition", "total", "bounds", "last_id", "doc_count", "state", "updated_at")
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NOW())
+ON CONFLICT ("app_name", "namespace", "partition")
+DO UPDATE SET "last_id" = EXCLUDED.last_id, "doc_count" = EXCLUDED.doc_count, "state" = EXCLUDED.state, "updated_at" = EXCLUDED.updated_at;`
+}
+
+// DeleteSyncProgress removes the progress of namespace $2 for appname $1
+func (q *Queries) DeleteSyncProgress() string {
+	return `DELETE FROM moresql_sync_progress WHERE app_name=$1 AND namespace=$2;`
+}
+
+// DeleteAllSyncProgress removes the progress of every namespace for appname $1
+func (q *Queries) DeleteAllSyncProgress() string {
+	return `DELETE FROM moresql_sync_progress WHERE app_name=$1;`
+}
+
+// SchemaExists counts the schemas named $1
+func (q *Queries) SchemaExists() string {
+	return `SELECT count(*) FROM pg_catalog.pg_namespace WHERE nspname = $1;`
+}
+
+// TableExists counts the tables named $2 in schema $1
+func (q *Queries) TableExists() string {
+	return `SELECT count(*) FROM pg_catalog.pg_tables WHERE schemaname = $1 AND tablename = $2;`
 }
 
 type Commands struct{}
@@ -182,11 +293,19 @@ func (c *Commands) CreateTableSQL() {
 	q := Queries{}
 	fmt.Print("-- Execute the following SQL to setup table in Postgres. Replace $USERNAME with the moresql user.")
 	fmt.Println(q.CreateMetadataTable())
-	os.Exit(0)
+	fmt.Print("-- Or, when upgrading from a previous release, execute the following SQL instead.")
+	fmt.Println(q.MigrateMetadataTable())
 }
 
 type ColumnResult struct {
-	Name string `db:"column_name"`
+	Name     string `db:"column_name"`
+	DataType string `db:"data_type"`
+	UdtName  string `db:"udt_name"`
+	Nullable string `db:"is_nullable"`
+}
+
+func (c ColumnResult) isNullable() bool {
+	return c.Nullable == "YES"
 }
 
 type TableColumn struct {
@@ -199,11 +318,47 @@ type TableColumn struct {
 }
 
 func (t *TableColumn) uniqueIndex() string {
-	return fmt.Sprintf("CREATE UNIQUE INDEX %s_service_uindex_on_%s ON %s.%s (%s);", t.Table, t.Column, t.Schema, t.Table, t.Column)
+	index := Export{Name: fmt.Sprintf("%s_service_uindex_on_%s", t.Table, t.Column)}.nameQuoted()
+	return fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s (%s);", index, t.tableQuoted(), t.columnQuoted())
 }
 
 func (t *TableColumn) createColumn() string {
-	return fmt.Sprintf(`ALTER TABLE %s.%s ADD %s %s NULL;`, t.Schema, t.Table, normalizeDotNotationToPostgresNaming(t.Column), t.Type)
+	column := Export{Name: normalizeDotNotationToPostgresNaming(t.Column)}.nameQuoted()
+	return fmt.Sprintf(`ALTER TABLE %s ADD %s %s NULL;`, t.tableQuoted(), column, t.Type)
+}
+
+func (t *TableColumn) createSchema() string {
+	return fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s;", t.schemaQuoted())
+}
+
+// tableQuoted and columnQuoted quote the names the same way
+// Collection.pgTableQuoted does, keeping mixed case or
+// reserved names intact
+func (t *TableColumn) tableQuoted() string {
+	return Collection{Schema: t.Schema, Name: t.Table}.pgTableQuoted()
+}
+
+// schemaQuoted is the schema the unquoted schema of
+// pgTableQuoted resolves to, postgres folds it to lower case
+func (t *TableColumn) schemaQuoted() string {
+	return Export{Name: strings.ToLower(t.Schema)}.nameQuoted()
+}
+
+func (t *TableColumn) columnQuoted() string {
+	return Export{Name: t.Column}.nameQuoted()
+}
+
+func (t *TableColumn) alterColumnType() string {
+	column := t.columnQuoted()
+	return fmt.Sprintf(`ALTER TABLE %s ALTER COLUMN %s TYPE %s USING %s::%s;`, t.tableQuoted(), column, t.Type, column, t.Type)
+}
+
+func (t *TableColumn) dropNotNull() string {
+	return fmt.Sprintf(`ALTER TABLE %s ALTER COLUMN %s DROP NOT NULL;`, t.tableQuoted(), t.columnQuoted())
+}
+
+func (t *TableColumn) addColumnIfNotExists() string {
+	return fmt.Sprintf(`ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s;`, t.tableQuoted(), t.columnQuoted(), t.Type)
 }
 
 type hasUniqueIndex struct {
@@ -217,94 +372,32 @@ func (h *hasUniqueIndex) isValid() bool {
 	return false
 }
 
-func (c *Commands) ValidateTablesAndColumns(config Config, pg *sqlx.DB) {
-	q := Queries{}
-	missingColumns := []TableColumn{}
-	// Validates configuration of Postgres based on config file
-	// Only validates SELECT and column existance
-	for _, db := range config {
-		for _, coll := range db.Collections {
-			table := coll.Name
-			// TODO: allow for non-public schema
-			schema := coll.Schema
-			// Check that all columns are present
-			rows, err := pg.NamedQuery(q.GetColumnsFromTable(), map[string]interface{}{"schema": schema, "table": table})
-			if err != nil {
-				log.Error(err)
-			}
-			// TODO: add validation that column types equal the types present in config
-
-			resultMap := make(map[string]string)
-			for rows.Next() {
-				var row ColumnResult
-				err := rows.StructScan(&row)
-				if err != nil {
-					log.Fatalln(err)
-				}
-				resultMap[row.Name] = row.Name
-			}
-
-			for _, orderField := range coll.OrderedCols {
-				for _, field := range coll.Fields {
-					k := field.Export.Name
-					if orderField == k {
-						_, ok := resultMap[k]
-						if ok != true {
-							t := TableColumn{Schema: schema, Table: table, Column: k, Message: "Missing Column", Type: field.Export.Type}
-							t.Solution = t.createColumn()
-							missingColumns = append(missingColumns, t)
-						}
-					}
-				}
-			}
-
-			if len(coll.ExtraProps) > 0 {
-				_, ok := resultMap["_extra_props"]
-				if !ok {
-					t := TableColumn{Schema: schema, Table: table, Column: "_extra_props", Message: "Missing Column", Type: coll.ExtraProps}
-					t.Solution = t.createColumn()
-					missingColumns = append(missingColumns, t)
-				}
-			}
-
-			// Check that each table has _id as in a unique index
-			r := hasUniqueIndex{}
-			err = pg.Get(&r, q.GetTableColumnIndexMetadata(), table, "id")
-			if err != nil {
-				log.Error(err)
-			}
-
-			if r.isValid() == false {
-				t := TableColumn{Schema: schema, Table: table, Column: "id", Message: "Missing Unique Index on Column", Type: ""}
-				t.Solution = t.uniqueIndex()
-				missingColumns = append(missingColumns, t)
-			}
-
-		}
+// ValidateTablesAndColumns reports the changes PlanSchema and
+// PlanColumnTypes find for the configured tables, along with
+// the SQL to correct them, and fails when there are any
+func (c *Commands) ValidateTablesAndColumns(config Config, exports []string, pg *sqlx.DB) error {
+	changes, err := c.PlanSchema(config, exports, pg, false)
+	if err != nil {
+		return err
+	}
+	types, err := c.PlanColumnTypes(config, exports, pg)
+	if err != nil {
+		return err
 	}
-	if len(missingColumns) != 0 {
+	changes = append(changes, types...)
+	if len(changes) != 0 {
 		log.Print("The following errors were reported:")
-		tables := make(map[string]TableColumn)
-		for _, v := range missingColumns {
+		for _, v := range changes {
 			log.Printf("Table %s.%s Column: %s, Error: %s", v.Schema, v.Table, v.Column, v.Message)
-			tables[v.Table] = v
 		}
 		log.Printf("SQL Output to assist with correcting table schema malformation:")
-
-		// Table level advice
-		// CREATE TABLE IF NOT EXISTS public.distributions();
-		for _, v := range tables {
-			fmt.Printf("CREATE TABLE IF NOT EXISTS %s.%s();\n", v.Schema, v.Table)
-		}
-
-		// Column level advice
-		for _, v := range missingColumns {
+		for _, v := range changes {
 			fmt.Printf("%s\n", v.Solution)
 		}
-		os.Exit(1)
+		return fmt.Errorf("validation found %d problems with the postgres tables", len(changes))
 	}
 	log.Printf("Validation succeeded. Postgres tables look good.")
-	os.Exit(0)
+	return nil
 }
 
 type Mongo struct {
@@ -325,7 +418,7 @@ func (p Export) nameQuoted() string {
 
 type Field struct {
 	Mongo  Mongo  `json:"mongo"`
-	Export Export `json:export`
+	Export Export `json:"export"`
 }
 type Fields map[string]Field
 type FieldShorthand map[string]string
@@ -356,6 +449,9 @@ type CollectionDelayed struct {
 }
 
 func (c Collection) pgTableQuoted() string {
+	if c.Schema == "" {
+		return fmt.Sprintf(`"%s"`, c.Name)
+	}
 	return fmt.Sprintf(`%s."%s"`, c.Schema, c.Name)
 }
 
@@ -504,3 +600,107 @@ func (o *Statement) BuildUpdate() string {
 func (o *Statement) BuildDelete() string {
 	return fmt.Sprintf("DELETE FROM %s %s;", o.Collection.pgTableQuoted(), o.whereById())
 }
+
+// BuildCreateTable builds the table for the collection's fields,
+// the id column comes first and _extra_props last
+func (o *Statement) BuildCreateTable() string {
+	columns := []string{}
+	if id, ok := o.Collection.Fields["_id"]; ok {
+		columns = append(columns, fmt.Sprintf("    %s %s NOT NULL", id.Export.nameQuoted(), id.Export.Type))
+	}
+	for _, k := range o.sortedKeys() {
+		v := o.Collection.Fields[k]
+		if k != "_id" {
+			columns = append(columns, fmt.Sprintf("    %s %s NULL", v.Export.nameQuoted(), v.Export.Type))
+		}
+	}
+	if len(o.Collection.ExtraProps) > 0 {
+		columns = append(columns, fmt.Sprintf(`    "%s" %s NULL`, "_extra_props", o.Collection.ExtraProps))
+	}
+	createTable := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (", o.Collection.pgTableQuoted())
+	return o.joinLines(createTable, strings.Join(columns, ",\n"), ");")
+}
+
+// maxBulkParams is the postgres limit on bind parameters per statement
+const maxBulkParams = 65535
+
+// bulkColumns lists the export columns in the order
+// used by the bulk statements and BulkValues
+func (o *Statement) bulkColumns() []string {
+	fields := o.postgresFields()
+	if len(o.Collection.ExtraProps) > 0 {
+		fields = append(fields, "_extra_props")
+	}
+	return fields
+}
+
+// BulkRowLimit is the largest number of rows that fit
+// into a single bulk statement for this collection
+func (o *Statement) BulkRowLimit() int {
+	return maxBulkParams / len(o.bulkColumns())
+}
+
+func (o *Statement) bulkPlaceholders(rows int, cols int) string {
+	values := []string{}
+	n := 1
+	for r := 0; r < rows; r++ {
+		row := []string{}
+		for c := 0; c < cols; c++ {
+			row = append(row, fmt.Sprintf("$%d", n))
+			n++
+		}
+		values = append(values, fmt.Sprintf("(%s)", strings.Join(row, ", ")))
+	}
+	return strings.Join(values, ",\n")
+}
+
+func (o *Statement) buildExcludedAssignment() string {
+	set := []string{}
+	for _, k := range o.sortedKeys() {
+		v := o.Collection.Fields[k]
+		if k != "_id" {
+			set = append(set, fmt.Sprintf(`%s = EXCLUDED.%s`, v.Export.nameQuoted(), v.Export.nameQuoted()))
+		}
+	}
+	if len(o.Collection.ExtraProps) > 0 {
+		set = append(set, fmt.Sprintf(`"%s" = EXCLUDED."%s"`, "_extra_props", "_extra_props"))
+	}
+	return strings.Join(set, ", ")
+}
+
+// BuildBulkInsert builds a multi row insert using
+// positional placeholders filled by BulkValues
+func (o *Statement) BuildBulkInsert(rows int) string {
+	fields := o.postgresExtraPropsQuoted(o.postgresFieldsQuoted())
+	insertInto := fmt.Sprintf("INSERT INTO %s (%s)", o.Collection.pgTableQuoted(), strings.Join(fields, ", "))
+	values := fmt.Sprintf("VALUES %s", o.bulkPlaceholders(rows, len(fields)))
+	return o.joinLines(insertInto, values)
+}
+
+// BuildBulkUpsert builds a multi row upsert, rows must
+// carry distinct ids for postgres to accept it
+func (o *Statement) BuildBulkUpsert(rows int) string {
+	insert := o.BuildBulkInsert(rows)
+	onConflict := fmt.Sprintf("ON CONFLICT (%s)", o.id().Export.nameQuoted())
+	doUpdate := fmt.Sprintf("DO UPDATE SET %s;", o.buildExcludedAssignment())
+	return o.joinLines(insert, onConflict, doUpdate)
+}
+
+// BuildBulkDelete builds a delete for the given number of ids
+func (o *Statement) BuildBulkDelete(rows int) string {
+	placeholders := []string{}
+	for i := 1; i <= rows; i++ {
+		placeholders = append(placeholders, fmt.Sprintf("$%d", i))
+	}
+	return fmt.Sprintf("DELETE FROM %s WHERE %s IN (%s);", o.Collection.pgTableQuoted(), o.id().Export.nameQuoted(), strings.Join(placeholders, ", "))
+}
+
+// BulkValues flattens sanitized data into the
+// positional arguments of a bulk insert or upsert
+func (o *Statement) BulkValues(data map[string]interface{}) []interface{} {
+	values := []interface{}{}
+	for _, k := range o.bulkColumns() {
+		values = append(values, data[k])
+	}
+	return values
+}
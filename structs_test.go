@@ -18,3 +18,14 @@ func (s *MySuite) TestUseSSL(c *C) {
 		c.Check(actual, DeepEquals, t.result)
 	}
 }
+
+func (s *MySuite) TestGetTableColumnIndexMetadata(c *C) {
+	q := m.Queries{}
+	sql := q.GetTableColumnIndexMetadata()
+	// A covering index on id with INCLUDE columns still has a single key
+	c.Check(sql, Matches, `(?s).*AND ix\.indnkeyatts = 1\n.*`)
+	c.Check(sql, Not(Matches), `(?s).*indnatts.*`)
+	c.Check(sql, Matches, `(?s).*a\.attnum = ix\.indkey\[0\].*`)
+	c.Check(sql, Matches, `(?s).*ix\.indisunique\n  AND ix\.indisvalid.*`)
+	c.Check(sql, Matches, `(?s).*ix\.indpred IS NULL\n  AND ix\.indexprs IS NULL;`)
+}
@@ -2,53 +2,56 @@ package moresql
 
 import (
 	"bufio"
-	"github.com/jmoiron/sqlx"
-	log "github.com/sirupsen/logrus"
+	"fmt"
 	"os"
+
+	"github.com/jmoiron/sqlx"
 )
 
-func SyncFile(config Config, pg *sqlx.DB, env Env) {
-	validateSyncFileParams(env)
+func SyncFile(config Config, pg *sqlx.DB, env Env) error {
+	if err := validateSyncFileParams(env); err != nil {
+		return err
+	}
 
 	file, err := os.Open(env.syncFilePath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer file.Close()
 
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		processInLine(scanner.Text(), env.syncFileCollection, env.syncFileDatabase, config, pg)
-	}
-
-	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+		if err := processInLine(scanner.Text(), env.syncFileCollection, env.syncFileDatabase, config, pg); err != nil {
+			return err
+		}
 	}
+	return scanner.Err()
 }
 
-func validateSyncFileParams(env Env) {
+func validateSyncFileParams(env Env) error {
 	if len(env.syncFilePath) == 0 {
-		log.Warnf(`Missing required variable. SYNC_FILE_PATH must be set.`)
-		os.Exit(1)
+		return fmt.Errorf("missing required variable, SYNC_FILE_PATH must be set")
 	}
 
 	if len(env.syncFileCollection) == 0 {
-		log.Warnf(`Missing required variable. SYNC_FILE_COLLECTION must be set.`)
-		os.Exit(1)
+		return fmt.Errorf("missing required variable, SYNC_FILE_COLLECTION must be set")
 	}
 
 	if len(env.syncFileDatabase) == 0 {
-		log.Warnf(`Missing required variable. SYNC_FILE_DATABASE must be set.`)
-		os.Exit(1)
+		return fmt.Errorf("missing required variable, SYNC_FILE_DATABASE must be set")
 	}
+	return nil
 }
 
-func processInLine(in, collectionName, db string, config Config, pg *sqlx.DB) {
+func processInLine(in, collectionName, db string, config Config, pg *sqlx.DB) error {
 	st := FullSyncer{Config: config}
 	o, c := st.statementFromDbCollection(db, collectionName)
 	data, err := SanitizeDataFile(c, in, true)
 	if err != nil {
-		log.WithFields(log.Fields{"collection": collectionName, "error": err, "data": in}).Fatal("Error SanitizeData")
+		return fmt.Errorf("sanitizing %s of %s.%s: %s", in, db, collectionName, err)
+	}
+	if _, err := pg.NamedExec(o.BuildUpsert(), data); err != nil {
+		return fmt.Errorf("writing %s to %s.%s: %s", in, db, collectionName, err)
 	}
-	pg.NamedExec(o.BuildUpsert(), data)
+	return nil
 }
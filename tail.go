@@ -4,8 +4,12 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"regexp"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 
 	"time"
 
@@ -15,7 +19,6 @@ import (
 	cmap "github.com/orcaman/concurrent-map"
 	"github.com/paulbellamy/ratecounter"
 	"github.com/rwynn/gtm"
-	"github.com/serialx/hashring"
 	log "github.com/sirupsen/logrus"
 	"github.com/thejerf/suture"
 	"go.mongodb.org/mongo-driver/bson"
@@ -35,27 +38,70 @@ type Tailer struct {
 	env          Env
 	counters     map[string]counters
 	stop         chan bool
+	stopOnce     sync.Once
+	quit         chan struct{}
+	readDone     chan struct{}
+	inflight     sync.WaitGroup
 	fan          map[string]chan Op
 	checkpoint   *cmap.ConcurrentMap
+	tracker      *CheckpointTracker
+	exporters    map[string]Exporter
+	deadLetters  DeadLetterStore
+	closeOnce    sync.Once
+	// activity holds when each fan last processed an op
+	activity *cmap.ConcurrentMap
+	// serving is 1 while Serve runs
+	serving int32
+	// gates pause the fans from the admin API
+	gates map[string]*fanGate
+	// mu guards swapping fan and gates, both are replaced
+	// rather than changed so readers may keep a copy
+	mu       sync.RWMutex
+	overflow []chan Op
+	reloads  chan reloadRequest
+	// ctx is the context of serve, done once the Tailer is shut down
+	ctx context.Context
+	// failed is closed once the Tailer stops on err
+	failed   chan struct{}
+	failOnce sync.Once
+	err      error
+	// stopWrites cancels the retries of the exporters once failed
+	stopWrites context.CancelFunc
+	// read is the position of the ops Read dispatched
+	read readPosition
 }
 
 type Op struct {
 	data   *gtm.Op
 	export string
+	// collection is the config of the op's collection when it was read
+	collection Collection
+	tracked    *TrackedOp
+	router     *KeyedRouter
 }
 
 // Stop is the func necessary to terminate action
 // when using Suture library
+// Stop makes Serve, Read and any reconnect wait return,
+// it is safe to call more than once
 func (t *Tailer) Stop() {
-	fmt.Println("Stopping service")
-	t.stop <- true
+	t.stopOnce.Do(func() {
+		fmt.Println("Stopping service")
+		close(t.stop)
+	})
 }
 
-func (t *Tailer) startOverflowConsumers(c <-chan Op) {
+// startOverflowConsumers starts one generic worker per overflow lane,
+// the lanes are shared by every fan
+func (t *Tailer) startOverflowConsumers() []chan Op {
 	exportSize := len(strings.Split(t.env.exports, ","))
+	overflow := []chan Op{}
 	for i := 1; i <= workerCountOverflow*exportSize; i++ {
-		go t.consumer(strconv.Itoa(i), c, nil)
+		c := make(chan Op, laneBufferSize)
+		overflow = append(overflow, c)
+		go t.consumer(strconv.Itoa(i), c, "Generic")
 	}
+	return overflow
 }
 
 type EpochTimestamp int64
@@ -65,10 +111,15 @@ func now() time.Time {
 }
 
 func BuildOptionAfterFromTimestamp(timestamp EpochTimestamp, replayDuration time.Duration) (func(*mongo.Client, *gtm.Options) (primitive.Timestamp, error), error) {
-	if timestamp != EpochTimestamp(0) && int64(timestamp) < time.Now().Unix() {
+	return BuildOptionAfterFromMongoTimestamp(primitive.Timestamp{T: uint32(timestamp), I: 1}, replayDuration)
+}
+
+// BuildOptionAfterFromMongoTimestamp resumes at the exact oplog position
+// of timestamp, falling back to replayDuration when there is none
+func BuildOptionAfterFromMongoTimestamp(timestamp primitive.Timestamp, replayDuration time.Duration) (func(*mongo.Client, *gtm.Options) (primitive.Timestamp, error), error) {
+	if timestamp.T != 0 && int64(timestamp.T) < time.Now().Unix() {
 		// We have a starting oplog entry
-		f := func() time.Time { return time.Unix(int64(timestamp), 0) }
-		return OpTimestampWrapper(f, time.Duration(0)), nil
+		return func(*mongo.Client, *gtm.Options) (primitive.Timestamp, error) { return timestamp, nil }, nil
 	}
 	if replayDuration != time.Duration(0) {
 		return OpTimestampWrapper(now, replayDuration), nil
@@ -77,14 +128,17 @@ func BuildOptionAfterFromTimestamp(timestamp EpochTimestamp, replayDuration time
 }
 
 func (t *Tailer) NewOptions(timestamp EpochTimestamp, replayDuration time.Duration) (*gtm.Options, error) {
+	return t.NewOptionsFromTimestamp(primitive.Timestamp{T: uint32(timestamp), I: 1}, replayDuration)
+}
+
+func (t *Tailer) NewOptionsFromTimestamp(timestamp primitive.Timestamp, replayDuration time.Duration) (*gtm.Options, error) {
 	options := gtm.DefaultOptions()
-	after, err := BuildOptionAfterFromTimestamp(timestamp, replayDuration)
+	after, err := BuildOptionAfterFromMongoTimestamp(timestamp, replayDuration)
 	if err != nil {
 		return nil, err
 	}
 	actual, _ := after(nil, nil)
-	epoch, _ := gtm.ParseTimestamp(actual)
-	log.WithFields(log.Fields{"app_name": t.env.appName}).Infof("Starting from epoch: %+v", epoch)
+	log.WithFields(log.Fields{"app_name": t.env.appName}).Infof("Starting from timestamp: %d.%d", actual.T, actual.I)
 	options.After = after
 	options.BufferSize = 500
 	options.BufferDuration = time.Duration(500 * time.Millisecond)
@@ -92,91 +146,207 @@ func (t *Tailer) NewOptions(timestamp EpochTimestamp, replayDuration time.Durati
 	options.Filter = func(op *gtm.Op) bool {
 		return op.Namespace != "config.system.sessions"
 	}
+	options.NamespaceFilter = NamespaceFilter(t.config)
 	return options, nil
 }
 
-func (t *Tailer) ChangeStreamOptions(op *gtm.Options) {
-	if len(t.fan) > 0 {
-		var changeStream []string
-		for k := range t.fan {
-			s := strings.Split(k, ".")
-			changeStream = append(changeStream, s[0]+"."+s[1])
+// ResumeTokenOptions resumes each change stream with resumeAfter from the
+// tokens in metadata. Tokens are only used when every stream has one,
+// since gtm starts a stream without a token from the current time.
+func (t *Tailer) ResumeTokenOptions(op *gtm.Options, metadata MoresqlMetadata) {
+	tokens, err := metadata.DecodeResumeTokens()
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Warn("Unable to decode resume tokens, resuming from timestamp")
+		return
+	}
+	if len(op.ChangeStreamNs) == 0 {
+		return
+	}
+	for _, ns := range op.ChangeStreamNs {
+		if _, ok := tokens[ns]; !ok {
+			return
 		}
-		op.ChangeStreamNs = changeStream
+	}
+	for ns, token := range tokens {
+		t.checkpoint.Set(resumeTokenKey(ns), token)
+	}
+	log.WithFields(log.Fields{"streams": len(tokens)}).Info("Resuming change streams from resume tokens")
+	op.Token = func(client *mongo.Client, ns string, o *gtm.Options) (interface{}, error) {
+		token, _ := t.checkpoint.Get(resumeTokenKey(ns))
+		return token, nil
+	}
+}
+
+// ChangeStreamOptions opens one change stream per configured collection,
+// each matching its condition_field on the server
+func (t *Tailer) ChangeStreamOptions(op *gtm.Options) {
+	if namespaces := WatchedNamespaces(t.config); len(namespaces) > 0 {
+		op.ChangeStreamNs = namespaces
 		op.OpLogDisabled = true
+		op.Pipe = ChangeStreamPipeline(t.config, strings.Split(t.env.exports, ","))
 	}
 }
 
+// fanBufferSize is the ops each fan buffers before Read blocks
+const fanBufferSize = 1000
+
 func (t *Tailer) NewFan() map[string]chan Op {
 	fan := make(map[string]chan Op)
 	// Register Channels
 	for dbName, db := range t.config {
 		for collectionName := range db.Collections {
 			for _, export := range strings.Split(t.env.exports, ",") {
-				fan[createFanKey(dbName, collectionName, export)] = make(chan Op, 1000)
+				fan[createFanKey(dbName, collectionName, export)] = make(chan Op, fanBufferSize)
 			}
 		}
 	}
 	return fan
 }
 
-func consistentBroker(in chan Op, ring *hashring.HashRing, workerPool map[string]chan Op) {
+// keyedBroker hands each op of a fan to the lane picked by its
+// router, which keeps ops of the same _id in order. Ops are held
+// by gate while the fan is paused, once it is full in isn't read
+// so the fan fills up and dispatch blocks. Once in is closed the
+// held ops are sent and the first dedicated lanes are closed.
+func keyedBroker(in chan Op, router *KeyedRouter, lanes []chan Op, dedicated int, gate *fanGate) {
+	send := func(op Op) {
+		op.router = router
+		lane := router.Acquire(routerKey(op))
+		lanes[lane] <- op
+	}
 	for {
+		next := in
+		if gate.full() {
+			next = nil
+		}
 		select {
-		case op := <-in:
-			node, ok := ring.GetNode(fmt.Sprintf("%s", op.data.Id))
+		case op, ok := <-next:
 			if !ok {
-				log.Error("Failed at getting worker node from hashring")
-			} else {
-				out := workerPool[node]
-				out <- op
+				for _, op := range gate.retire() {
+					send(op)
+				}
+				for _, lane := range lanes[:dedicated] {
+					close(lane)
+				}
+				return
+			}
+			if !gate.hold(op) {
+				send(op)
+			}
+		case <-gate.resumed:
+			for _, op := range gate.release() {
+				send(op)
 			}
 		}
 	}
 }
 
-func (t *Tailer) startDedicatedConsumers(fan map[string]chan Op, overflow chan Op) {
+// startDedicatedConsumers starts the workers of each fan,
+// returning the gates pausing them
+func (t *Tailer) startDedicatedConsumers(fan map[string]chan Op, overflow []chan Op) map[string]*fanGate {
+	gates := make(map[string]*fanGate)
 	// Reserved workers for individual channels
 	for k, c := range fan {
-		workerPool := make(map[string]chan Op)
-		var workers [workerCount]int
-		for i := range workers {
-			o := make(chan Op)
-			workerPool[strconv.Itoa(i)] = o
-		}
-		keys := []string{}
-		for k := range workerPool {
-			keys = append(keys, k)
-		}
-		ring := hashring.New(keys)
-		wg.Add(1)
-		go consistentBroker(c, ring, workerPool)
-		for k, workerChan := range workerPool {
-			go t.consumer(k, workerChan, overflow)
+		lanes := []chan Op{}
+		for i := 0; i < workerCount; i++ {
+			o := make(chan Op, laneBufferSize)
+			lanes = append(lanes, o)
+			go t.consumer(strconv.Itoa(i), o, "Dedicated")
 		}
+		lanes = append(lanes, overflow...)
+		router := NewKeyedRouter(k, workerCount, len(overflow), func(lane int) int { return len(lanes[lane]) })
+		gate := newFanGate(maxHeldOps)
+		gates[k] = gate
+		go keyedBroker(c, router, lanes, workerCount, gate)
 		log.WithFields(log.Fields{
 			"count":      workerCount,
 			"collection": k,
 		}).Debug("Starting worker(s)")
 	}
+	return gates
 }
 
 type MoresqlMetadata struct {
-	AppName     string    `db:"app_name" bson:"app_name"`
-	LastEpoch   int64     `db:"last_epoch" bson:"last_epoch"`
-	ProcessedAt time.Time `db:"processed_at" bson:"processed_at"`
+	AppName      string    `db:"app_name" bson:"app_name"`
+	LastEpoch    int64     `db:"last_epoch" bson:"last_epoch"`
+	LastOrdinal  int64     `db:"last_ordinal" bson:"last_ordinal"`
+	ResumeTokens string    `db:"resume_tokens" bson:"resume_tokens"`
+	ProcessedAt  time.Time `db:"processed_at" bson:"processed_at"`
 }
 
-func NewTailer(config Config, pg *sqlx.DB, client *mongo.Client, env Env, clientExport *mongo.Client) *Tailer {
+// NewTailer builds the Tailer of o, its exporters and dead letters
+func NewTailer(o Options) (*Tailer, error) {
+	env := o.Env
 	checkpoint := cmap.New()
 	initCounters := make(map[string]counters)
+	initExporters := make(map[string]Exporter)
+	if env.checkpoint && o.Postgres != nil && !HasTypeExport(strings.Split(env.exports, ","), mongoExport) {
+		if err := MigrateMetadata(o.Postgres); err != nil {
+			return nil, err
+		}
+	}
+	deadLetters, err := OpenDeadLetters(env, o.Postgres)
+	if err != nil {
+		return nil, fmt.Errorf("opening dead letters: %s", err)
+	}
+	writes, stopWrites := context.WithCancel(context.Background())
+	eo := ExporterOptions{Config: o.Config, Postgres: o.Postgres, Mongo: o.MongoExport, Env: env, DeadLetters: deadLetters, Retry: NewRetryPolicy(env), Context: writes}
 	for _, export := range strings.Split(env.exports, ",") {
 		initCounters[export] = buildCounters(export)
+		exporter, err := NewExporter(export, eo)
+		if err != nil {
+			stopWrites()
+			return nil, fmt.Errorf("building exporter %s: %s", export, err)
+		}
+		initExporters[export] = exporter
 	}
-	return &Tailer{config: config, pg: pg, client: client, env: env, stop: make(chan bool), counters: initCounters, checkpoint: &checkpoint, clientExport: clientExport}
+	activity := cmap.New()
+	t := &Tailer{config: o.Config, pg: o.Postgres, client: o.Mongo, env: env, stop: make(chan bool), quit: make(chan struct{}), counters: initCounters, checkpoint: &checkpoint, clientExport: o.MongoExport, exporters: initExporters, deadLetters: deadLetters, activity: &activity, reloads: make(chan reloadRequest), ctx: context.Background(), failed: make(chan struct{}), readDone: make(chan struct{}), stopWrites: stopWrites}
+	t.tracker = NewCheckpointTracker(t.markSafe)
+	t.tracker.limit = maxTrackedOps
+	return t, nil
+}
+
+// options are the Options the Tailer was built with,
+// with the config it currently runs
+func (t *Tailer) options() Options {
+	return Options{Config: t.config, Env: t.env, Postgres: t.pg, Mongo: t.client, MongoExport: t.clientExport}
+}
+
+// fail stops the Tailer on an error it can't recover from. The op
+// that failed isn't acked, so the checkpoint can't move past it.
+func (t *Tailer) fail(err error) {
+	t.failOnce.Do(func() {
+		log.WithField("error", err).Error("Tailer failed")
+		t.err = err
+		t.stopWrites()
+		close(t.failed)
+	})
 }
 
-func (t *Tailer) FetchMetadata() (metadata MoresqlMetadata) {
+// Err is the error that stopped the Tailer, nil while it runs
+func (t *Tailer) Err() error {
+	select {
+	case <-t.failed:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// markSafe moves the checkpoint to op once every op before
+// it has been committed by all exports
+func (t *Tailer) markSafe(op *gtm.Op) {
+	t.checkpoint.Set("database", op.GetDatabase())
+	t.checkpoint.Set("latest", t.OpToMoresqlMetadata(op))
+	if token := op.ResumeToken; token.ResumeToken != nil {
+		t.checkpoint.Set(resumeTokenKey(token.StreamID), token.ResumeToken)
+	}
+}
+
+// FetchMetadata reads the checkpoint of -checkpoint, it is empty when
+// there is no checkpoint yet
+func (t *Tailer) FetchMetadata() (metadata MoresqlMetadata, err error) {
 	if !t.env.checkpoint {
 		metadata.LastEpoch = 0
 		return
@@ -185,21 +355,22 @@ func (t *Tailer) FetchMetadata() (metadata MoresqlMetadata) {
 	if HasTypeExport(strings.Split(t.env.exports, ","), mongoExport) {
 		for db := range t.config {
 			collection := t.clientExport.Database(db).Collection("moresql_metadata")
-			err := collection.FindOne(context.TODO(), bson.M{"app_name": t.env.appName}).Decode(&metadata)
-			if err != nil {
-				log.Errorf("Error while reading moresql_metadata table %+v", err)
+			err := collection.FindOne(t.ctx, bson.M{"app_name": t.env.appName}).Decode(&metadata)
+			if err != nil && err != mongo.ErrNoDocuments {
+				return metadata, fmt.Errorf("reading moresql_metadata of %s: %s", db, err)
 			}
 		}
 		return
 	}
 
 	q := Queries{}
-	err := t.pg.Get(&metadata, q.GetMetadata(), t.env.appName)
+	err = t.pg.Get(&metadata, q.GetMetadata(), t.env.appName)
 	// No rows means this is first time with table
-	if err != nil && err != sql.ErrNoRows {
-		log.Errorf("Error while reading moresql_metadata table %+v", err)
-		c := Commands{}
-		c.CreateTableSQL()
+	if err == sql.ErrNoRows {
+		return metadata, nil
+	}
+	if err != nil {
+		return metadata, fmt.Errorf("reading moresql_metadata: %s", err)
 	}
 	return
 }
@@ -207,94 +378,170 @@ func (t *Tailer) FetchMetadata() (metadata MoresqlMetadata) {
 type gtmTail struct {
 	ops  gtm.OpChan
 	errs chan error
+	stop func()
 }
 
-func (t *Tailer) Read() {
-	metadata := t.FetchMetadata()
-
-	var lastEpoch int64
-	if t.env.replaySecond != 0 {
-		lastEpoch = int64(t.env.replaySecond)
-	} else {
-		lastEpoch = metadata.LastEpoch
-	}
-	options, err := t.NewOptions(EpochTimestamp(lastEpoch), t.env.replayDuration)
+// startGtm tails the change streams of options with gtm,
+// or the oplog of the configured collections
+func (t *Tailer) startGtm(options *gtm.Options) gtmTail {
 	if t.env.tailType == changeStream {
-		t.ChangeStreamOptions(options)
+		ctx := gtm.Start(t.client, options)
+		return gtmTail{ops: ctx.OpC, errs: ctx.ErrC, stop: ctx.Stop}
+	}
+	return startOplogTail(t.client, options, t.config)
+}
+
+// Read tails mongo and fans each op out to its exports. Errors from gtm
+// are classified: recoverable ones restart the tail from the last safe
+// checkpoint with backoff, a lost position applies -on-stream-invalidate
+// and anything else exits.
+func (t *Tailer) Read() {
+	metadata, err := t.FetchMetadata()
+	if err != nil {
+		close(t.readDone)
+		t.fail(err)
+		return
 	}
+	origin := t.originPosition(metadata)
+	options, err := t.tailOptions(origin)
 	if err != nil {
-		log.Fatal(err.Error())
+		close(t.readDone)
+		t.fail(err)
+		return
 	}
-	ops, errs := gtm.Tail(t.client, options)
-	g := gtmTail{ops, errs}
+	g := t.startGtm(options)
 	go func() {
+		defer close(t.readDone)
+		attempt := 0
 		for {
 			select {
 			case <-t.stop:
+				stopGtm(g)
+				return
+			case <-t.quit:
+				// Stop reading, gtm is stopped in the background as it
+				// blocks until its pending ops are consumed or dropped
+				stopGtm(g)
+				return
+			case <-t.failed:
+				stopGtm(g)
 				return
 			case err := <-g.errs:
-				if matched, _ := regexp.MatchString("i/o timeout", err.Error()); matched {
-					// Restart gtm.Tail
-					// Close existing channels to not leak resources
-					log.Errorf("Problem connecting to mongo initiating reconnection: %s", err.Error())
-					close(g.ops)
-					close(g.errs)
-					latest, ok := t.checkpoint.Get("latest")
-					if ok && latest != nil {
-						metadata = latest.(MoresqlMetadata)
-						lastEpoch = metadata.LastEpoch
-						options, err := t.NewOptions(EpochTimestamp(lastEpoch), t.env.replayDuration)
-						if err != nil {
-							log.Fatal(err.Error())
-						}
-						ops, errs = gtm.Tail(t.client, options)
-						fmt.Printf("ops: %+v\n", ops)
-						g = gtmTail{ops, errs}
-					} else {
-						log.Fatalf("Exiting: Unable to recover from %s", err.Error())
+				state := classifyStreamError(err)
+				switch state {
+				case streamRecoverable:
+					attempt++
+					var ok bool
+					if g, ok = t.reconnect(g, origin, attempt, err); !ok {
+						return
+					}
+				case streamPositionLost:
+					var ok bool
+					if g, ok = t.positionLost(g, err.Error()); !ok {
+						return
 					}
-				} else {
-					log.Fatalf("Exiting: Mongo tailer returned error %s", err.Error())
+				default:
+					stopGtm(g)
+					t.fail(fmt.Errorf("mongo tailer returned %s error %s", state, err.Error()))
+					return
 				}
 			case op := <-g.ops:
-				// Check if we're watching for the collection
-				db := op.GetDatabase()
-				coll := op.GetCollection()
-				for _, export := range strings.Split(t.env.exports, ",") {
-					t.counters[export].read.Incr(1)
-					log.WithFields(log.Fields{
-						"operation":  op.Operation,
-						"collection": op.GetCollection(),
-						"id":         op.Id,
-						"export":     export,
-					}).Debug("Received operation")
-					key := createFanKey(db, coll, export)
-					if c := t.fan[key]; c != nil {
-						collection := t.config[db].Collections[coll]
-						o := Statement{collection}
-						data := EnsureOpHasAllFields(op, o.mongoFields())
-						c <- Op{data, export}
-					} else {
-						t.counters[export].skipped.Incr(1)
-						log.Debug("Missing channel for this collection")
+				attempt = 0
+				if t.env.tailType == changeStream && isInvalidate(op, t.config) {
+					var ok bool
+					if g, ok = t.positionLost(g, fmt.Sprintf("change stream invalidated by %v on %s", op.Data, op.Namespace)); !ok {
+						return
 					}
+					continue
+				}
+				if !t.waitTracked() {
+					stopGtm(g)
+					return
 				}
-				for k, v := range t.fan {
-					if len(v) > 0 {
-						log.Debugf("Channel %s has %d", k, len(v))
+				t.read.record(op)
+				t.dispatch(op)
+			case req := <-t.reloads:
+				diff := t.applyConfig(req.config)
+				if diff.restartsTail(t.env.tailType) {
+					// Every op read was dispatched, the new tail
+					// starts after them and reads the rest again
+					stopGtm(g)
+					options, err := t.restartOptions(origin, diff.Added)
+					if err != nil {
+						req.done <- diff
+						t.fail(err)
+						return
 					}
+					g = t.startGtm(options)
 				}
+				req.done <- diff
 			}
 		}
 	}()
 }
 
+// dispatch hands op to the fan of every export watching its collection
+func (t *Tailer) dispatch(op *gtm.Op) {
+	// Check if we're watching for the collection
+	db := op.GetDatabase()
+	coll := op.GetCollection()
+	exports := strings.Split(t.env.exports, ",")
+	var tracked *TrackedOp
+	if t.tracker != nil {
+		// Track before fanning out so no worker can ack first
+		matched := 0
+		for _, export := range exports {
+			if t.fan[createFanKey(db, coll, export)] != nil {
+				matched++
+			}
+		}
+		tracked = t.tracker.Track(op, matched)
+	}
+	for _, export := range exports {
+		t.counters[export].read.Incr(1)
+		readTotal.Inc(db, coll, export)
+		log.WithFields(log.Fields{
+			"operation":  op.Operation,
+			"collection": op.GetCollection(),
+			"id":         op.Id,
+			"export":     export,
+		}).Debug("Received operation")
+		key := createFanKey(db, coll, export)
+		if c := t.fan[key]; c != nil {
+			collection := t.config[db].Collections[coll]
+			o := Statement{collection}
+			data := EnsureOpHasAllFields(op, o.mongoFields())
+			t.inflight.Add(1)
+			c <- Op{data: data, export: export, collection: collection, tracked: tracked}
+		} else {
+			t.counters[export].skipped.Incr(1)
+			skippedTotal.Inc(db, coll, export)
+			log.Debug("Missing channel for this collection")
+		}
+	}
+	for k, v := range t.fan {
+		if len(v) > 0 {
+			log.Debugf("Channel %s has %d", k, len(v))
+		}
+	}
+}
+
 func (t *Tailer) Write() {
-	t.fan = t.NewFan()
-	log.WithField("struct", t.fan).Debug("Fan")
-	overflow := make(chan Op)
-	t.startDedicatedConsumers(t.fan, overflow)
-	t.startOverflowConsumers(overflow)
+	fan := t.NewFan()
+	log.WithField("struct", fan).Debug("Fan")
+	overflow := t.startOverflowConsumers()
+	gates := t.startDedicatedConsumers(fan, overflow)
+	t.mu.Lock()
+	t.fan, t.gates, t.overflow = fan, gates, overflow
+	t.mu.Unlock()
+	t.channelDepths(overflow)
+}
+
+// fans are the current channel and gate of each fan key
+func (t *Tailer) fans() (map[string]chan Op, map[string]*fanGate) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.fan, t.gates
 }
 
 func (t *Tailer) Report() {
@@ -333,33 +580,75 @@ func (t *Tailer) SaveCheckpoint(m MoresqlMetadata, database string) error {
 	return err
 }
 
+// Flushes periodically writes out batched ops so that
+// none wait longer than -batch-duration
+func (t *Tailer) Flushes() {
+	go func() {
+		for range time.Tick(t.env.batchDuration) {
+			t.flushExporters()
+		}
+	}()
+}
+
 func (t *Tailer) Checkpoints() {
 	go func() {
 		timer := time.Tick(checkpointFrequency)
 		for {
 			select {
 			case _ = <-timer:
-				latest, ok := t.checkpoint.Get("latest")
-				database, success := t.checkpoint.Get("database")
-				if ok && latest != nil && database != nil && success {
-					t.SaveCheckpoint(latest.(MoresqlMetadata), database.(string))
-					log.Infof("Saved checkpointing %+v", latest.(MoresqlMetadata))
-				}
+				t.SaveLatestCheckpoint()
 			}
 		}
 	}()
 }
 
+// SaveLatestCheckpoint persists the current low watermark
+// along with the resume token of each change stream
+func (t *Tailer) SaveLatestCheckpoint() error {
+	latest, ok := t.checkpoint.Get("latest")
+	database, success := t.checkpoint.Get("database")
+	tokens := t.resumeTokens()
+	// Ops before latest may still be batched, flush them
+	// so the checkpoint never runs ahead of the sink
+	if err := t.flushExporters(); err != nil {
+		t.checkpoint.Set("saved", checkpointSave{At: time.Now(), Err: err.Error()})
+		return err
+	}
+	if !(ok && latest != nil && database != nil && success) {
+		return nil
+	}
+	m := latest.(MoresqlMetadata)
+	encoded, err := EncodeResumeTokens(tokens)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Unable to encode resume tokens")
+		encoded = "{}"
+	}
+	m.ResumeTokens = encoded
+	if err := t.SaveCheckpoint(m, database.(string)); err != nil {
+		t.checkpoint.Set("saved", checkpointSave{At: time.Now(), Err: err.Error()})
+		return err
+	}
+	t.checkpoint.Set("saved", checkpointSave{At: time.Now()})
+	log.Infof("Saved checkpointing %+v", m)
+	return nil
+}
+
 // Serve is the func necessary to start action
 // when using Suture library
 func (t *Tailer) Serve() {
+	atomic.StoreInt32(&t.serving, 1)
+	defer atomic.StoreInt32(&t.serving, 0)
 	t.Write()
 	t.Read()
 	t.Report()
+	if t.env.batchDuration > 0 {
+		t.Flushes()
+	}
 	if t.env.checkpoint {
 		t.Checkpoints()
 	}
 	<-t.stop
+	t.closeOutputs()
 }
 
 type counters struct {
@@ -399,6 +688,7 @@ func (t *Tailer) ReportCounters() {
 			log.Infof("Counter %s - Rate of %s per min: %d", export, i, c.Rate())
 		}
 	}
+	log.Infof("Mongo reconnects: %d", t.Reconnects())
 }
 
 func (t *Tailer) MsLag(epoch uint32, nowFunc func() time.Time) int64 {
@@ -409,65 +699,69 @@ func (t *Tailer) MsLag(epoch uint32, nowFunc func() time.Time) int64 {
 	return nanoToMillisecond(d)
 }
 
-func (t *Tailer) consumer(id string, in <-chan Op, overflow chan<- Op) {
-	var workerType string
-	if overflow != nil {
-		workerType = "Dedicated"
-	} else {
-		workerType = "Generic"
-	}
+func (t *Tailer) consumer(id string, in <-chan Op, workerType string) {
 	for {
-		if overflow != nil && len(in) > workerCount {
-			// Siphon off overflow
-			select {
-			case op := <-in:
-				overflow <- op
-			}
-			continue
-		}
 		select {
-		case op := <-in:
-			t.processOp(op, workerType)
-			if t.env.checkpoint {
-				t.checkpoint.Set("database", op.data.GetDatabase())
-				t.checkpoint.Set("latest", t.OpToMoresqlMetadata(op.data))
+		case op, ok := <-in:
+			if !ok {
+				// The fan was removed from the config
+				return
+			}
+			if err := t.processOp(op, workerType); err != nil {
+				t.fail(err)
+				return
+			}
+			if op.router != nil {
+				op.router.Release(routerKey(op))
 			}
+			if op.tracked != nil {
+				t.tracker.Ack(op.tracked)
+			}
+			t.inflight.Done()
 		}
 	}
 }
 
 func (t *Tailer) OpToMoresqlMetadata(op *gtm.Op) MoresqlMetadata {
-	ts, _ := gtm.ParseTimestamp(op.Timestamp)
-	return MoresqlMetadata{AppName: t.env.appName, ProcessedAt: time.Now(), LastEpoch: int64(ts)}
+	return MoresqlMetadata{AppName: t.env.appName, ProcessedAt: time.Now(), LastEpoch: int64(op.Timestamp.T), LastOrdinal: int64(op.Timestamp.I)}
 }
 
-func (t *Tailer) processOp(op Op, workerType string) {
+// processOp writes op to its export, the error returned stops the Tailer
+func (t *Tailer) processOp(op Op, workerType string) error {
 	collectionName := op.data.GetCollection()
 	db := op.data.GetDatabase()
-	st := FullSyncer{Config: t.config}
-	o, c := st.statementFromDbCollection(db, collectionName)
+	c := op.collection
 	isMongoExport := op.export == mongoExport
 	data, err := SanitizeData(c, op.data, len(c.ExtraProps) > 0, isMongoExport)
-	
+
 	if err != nil {
-		log.WithFields(log.Fields{"collection": collectionName,"error": err, "data": op.data.Data}).Fatal("Error SanitizeData")
+		log.WithFields(log.Fields{"collection": collectionName, "error": err, "data": op.data.Data}).Error("Error SanitizeData")
+		return fmt.Errorf("sanitizing %v of %s.%s: %s", op.data.Id, db, collectionName, err)
 	}
-	
+
 	if data["id"] == nil {
-		return
+		return nil
 	}
 
-	if op.export == csvExport {
-		t.exportCSV(op.data, c, data)
+	payload := map[string]interface{}{
+		"action":     op.data.Operation,
+		"collection": collectionName,
+		"database":   db,
+		"export":     op.export,
+		"timestamp":  op.data.Timestamp,
+		"data":       data,
 	}
-
-	if op.export == postgresExport {
-		t.exportPostgres(o, op.data, data, workerType)
+	lag := t.MsLag(op.data.Timestamp.T, time.Now)
+	replicationLag.Set(float64(lag), db, collectionName)
+	err = t.export(op, c, data)
+	t.recordActivity(op, lag)
+	if err != nil {
+		errorsTotal.Inc(db, collectionName, op.export)
 	}
-
-	if isMongoExport {
-		t.exportMongo(op.data, data, workerType)
+	if err != nil && t.deadLetters != nil {
+		err = t.saveDeadLetter(op, data, err)
 	}
+	return t.logFn(err, workerType, payload)
 }
 
 func OpTimestampWrapper(f func() time.Time, ago time.Duration) func(*mongo.Client, *gtm.Options) (primitive.Timestamp, error) {
@@ -479,10 +773,57 @@ func OpTimestampWrapper(f func() time.Time, ago time.Duration) func(*mongo.Clien
 	}
 }
 
-func Tail(config Config, pg *sqlx.DB, env Env, client *mongo.Client, clientExport *mongo.Client) {
+// Tail tails the collections of o until ctx is done, a signal
+// asks for a graceful shutdown or the Tailer fails
+func Tail(ctx context.Context, o Options) error {
+	t, err := NewTailer(o)
+	if err != nil {
+		return err
+	}
+	return serve(ctx, t, o.Env)
+}
+
+// serve runs service under a supervisor until it stops, fails,
+// or ctx or a signal asks for a graceful shutdown
+func serve(ctx context.Context, service *Tailer, env Env) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	service.ctx = ctx
+	healthTailer.Store(service)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigs)
+	hups := make(chan os.Signal, 1)
+	signal.Notify(hups, syscall.SIGHUP)
+	defer signal.Stop(hups)
 	supervisor := suture.NewSimple("Supervisor")
-	service := NewTailer(config, pg, client, env, clientExport)
 	supervisor.Add(service)
 	supervisor.ServeBackground()
-	<-service.stop
+	// Stops the Tailer however serve returns, closing its exporters
+	defer supervisor.Stop()
+	shutdown := func() error {
+		if err := service.Shutdown(env.shutdownTimeout); err != nil {
+			log.WithField("error", err).Error("Shutdown incomplete")
+			return err
+		}
+		return nil
+	}
+	for {
+		select {
+		case <-service.stop:
+			return nil
+		case <-service.failed:
+			return service.Err()
+		case <-hups:
+			if _, err := service.ReloadConfigFile(env.configFile); err != nil {
+				log.WithFields(log.Fields{"path": env.configFile, "error": err}).Error("Unable to reload config, keeping the running config")
+			}
+		case <-ctx.Done():
+			log.Info("Context done, shutting down")
+			return shutdown()
+		case sig := <-sigs:
+			log.WithField("signal", sig).Info("Received signal, shutting down")
+			return shutdown()
+		}
+	}
 }
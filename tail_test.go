@@ -1,10 +1,14 @@
 package moresql_test
 
 import (
+	"path/filepath"
 	"time"
 
+	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
+	"github.com/rwynn/gtm"
 	m "github.com/zph/moresql"
-	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	. "gopkg.in/check.v1"
 )
 
@@ -12,7 +16,7 @@ func (s *MySuite) TestTimestamp(c *C) {
 	startTime := time.Duration(1485144398995 * time.Millisecond)
 	f := func() time.Time { return time.Unix(0, startTime.Nanoseconds()) }
 	t, _ := m.OpTimestampWrapper(f, -1*time.Hour)(nil, nil)
-	expected := bson.MongoTimestamp(6378662081129873409)
+	expected := primitive.Timestamp{T: 1485147998, I: 1}
 	c.Check(t, Equals, expected)
 }
 
@@ -20,7 +24,7 @@ func (s *MySuite) TestNewOptionsWithEpoch(c *C) {
 	tail := m.Tailer{}
 	opts, err := tail.NewOptions(m.EpochTimestamp(1485144398), time.Duration(0))
 	actual, _ := opts.After(nil, nil)
-	expected := bson.MongoTimestamp(6378646619247607809)
+	expected := primitive.Timestamp{T: 1485144398, I: 1}
 	c.Check(actual, Equals, expected)
 	c.Check(err, Equals, nil)
 }
@@ -44,3 +48,49 @@ func (s *MySuite) TestMsLag(c *C) {
 		c.Check(actual, Equals, int64(tt.out))
 	}
 }
+
+func (s *MySuite) TestRecordRead(c *C) {
+	ts, tokens := m.RecordRead()
+	c.Check(ts, Equals, primitive.Timestamp{})
+	c.Check(tokens, IsNil)
+
+	ts, tokens = m.RecordRead(
+		&gtm.Op{Timestamp: primitive.Timestamp{T: 10, I: 2}, ResumeToken: gtm.OpResumeToken{StreamID: "db.users", ResumeToken: "a"}},
+		&gtm.Op{Timestamp: primitive.Timestamp{T: 10, I: 1}, ResumeToken: gtm.OpResumeToken{StreamID: "db.orders", ResumeToken: "b"}},
+		&gtm.Op{Timestamp: primitive.Timestamp{T: 9, I: 5}, ResumeToken: gtm.OpResumeToken{StreamID: "db.users", ResumeToken: "c"}},
+	)
+	c.Check(ts, Equals, primitive.Timestamp{T: 10, I: 2})
+	c.Check(tokens, DeepEquals, map[string]interface{}{"db.users": "c", "db.orders": "b"})
+}
+
+func (s *MySuite) TestWaitInflightStops(c *C) {
+	t := m.NewIdleTailer()
+	c.Check(t.WaitInflight(), Equals, true)
+
+	// An op held by a paused fan can't block a stop
+	t.HoldInflight()
+	waited := make(chan bool)
+	go func() { waited <- t.WaitInflight() }()
+	t.Stop()
+	select {
+	case ok := <-waited:
+		c.Check(ok, Equals, false)
+	case <-time.After(time.Second):
+		c.Fatal("waitInflight did not return once stopped")
+	}
+}
+
+func (s *MySuite) TestResnapshotWithoutPostgres(c *C) {
+	// Only -exports=csv or mongo, so there is no progress to clear
+	err := m.Resnapshot(m.Config{}, filepath.Join(c.MkDir(), "out.csv"))
+	c.Check(err, IsNil)
+}
+
+func (s *MySuite) TestReadFailsWithoutCheckpoint(c *C) {
+	// Nothing listens on port 1, the checkpoint can't be read
+	pg, err := sqlx.Open("postgres", "postgres://localhost:1/db?sslmode=disable&connect_timeout=1")
+	c.Assert(err, IsNil)
+	defer pg.Close()
+	err = m.ReadCheckpointFrom(pg)
+	c.Check(err, ErrorMatches, "reading moresql_metadata: .*")
+}
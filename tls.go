@@ -0,0 +1,86 @@
+package moresql
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+// TLSConfig builds the tls.Config of the -ssl-* flags: the CA bundle of
+// -ssl-cert, the client certificate of -ssl-client-cert/-ssl-client-key
+// and -ssl-insecure-skip-verify
+func (e *Env) TLSConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: e.SSLInsecureSkipVerify}
+	if len(e.SSLCert) > 0 {
+		pem, err := ioutil.ReadFile(e.SSLCert)
+		if err != nil {
+			return nil, fmt.Errorf("reading -ssl-cert: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("-ssl-cert %s holds no PEM certificate", e.SSLCert)
+		}
+		config.RootCAs = pool
+	}
+	if (len(e.SSLClientCert) > 0) != (len(e.SSLClientKey) > 0) {
+		return nil, fmt.Errorf("-ssl-client-cert and -ssl-client-key must be set together")
+	}
+	if len(e.SSLClientCert) > 0 {
+		cert, err := tls.LoadX509KeyPair(e.SSLClientCert, e.SSLClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading -ssl-client-cert: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// PostgresSSLURL adds the sslmode, sslrootcert, sslcert and sslkey of the
+// -ssl-* flags to a postgres url or key=value connection string. Options
+// already present in the connection string are kept.
+func PostgresSSLURL(conn string, e Env) (string, error) {
+	if !e.UseSSL() {
+		return conn, nil
+	}
+	params := [][2]string{}
+	if e.SSLInsecureSkipVerify {
+		// lib/pq verifies the CA whenever sslrootcert is set
+		params = append(params, [2]string{"sslmode", "require"})
+	} else {
+		params = append(params, [2]string{"sslmode", "verify-full"})
+		if len(e.SSLCert) > 0 {
+			params = append(params, [2]string{"sslrootcert", e.SSLCert})
+		}
+	}
+	if len(e.SSLClientCert) > 0 {
+		params = append(params, [2]string{"sslcert", e.SSLClientCert}, [2]string{"sslkey", e.SSLClientKey})
+	}
+
+	if strings.HasPrefix(conn, "postgres://") || strings.HasPrefix(conn, "postgresql://") {
+		u, err := url.Parse(conn)
+		if err != nil {
+			return "", fmt.Errorf("parsing POSTGRES_URL: %s", err)
+		}
+		query := u.Query()
+		for _, p := range params {
+			if _, ok := query[p[0]]; !ok {
+				query.Set(p[0], p[1])
+			}
+		}
+		u.RawQuery = query.Encode()
+		return u.String(), nil
+	}
+	for _, p := range params {
+		if !strings.Contains(conn, p[0]+"=") {
+			conn += fmt.Sprintf(" %s='%s'", p[0], connValueEscaper.Replace(p[1]))
+		}
+	}
+	return conn, nil
+}
+
+// connValueEscaper escapes a quoted value of a key=value connection
+// string, lib/pq reads both \ and ' after a backslash literally
+var connValueEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
@@ -0,0 +1,38 @@
+package moresql_test
+
+import (
+	m "github.com/zph/moresql"
+	. "gopkg.in/check.v1"
+)
+
+func (s *MySuite) TestPostgresSSLURL(c *C) {
+	conn, err := m.PostgresSSLURL("postgres://user@localhost/db", m.Env{})
+	c.Assert(err, IsNil)
+	c.Check(conn, Equals, "postgres://user@localhost/db")
+
+	env := m.Env{SSLCert: "/ca.pem", SSLClientCert: "/client.pem", SSLClientKey: "/client.key"}
+	conn, err = m.PostgresSSLURL("postgres://user@localhost/db?sslmode=verify-ca", env)
+	c.Assert(err, IsNil)
+	c.Check(conn, Equals, "postgres://user@localhost/db?sslcert=%2Fclient.pem&sslkey=%2Fclient.key&sslmode=verify-ca&sslrootcert=%2Fca.pem")
+
+	conn, err = m.PostgresSSLURL("host=localhost dbname=db", m.Env{SSLCert: "/ca.pem", SSLInsecureSkipVerify: true})
+	c.Assert(err, IsNil)
+	c.Check(conn, Equals, "host=localhost dbname=db sslmode='require'")
+
+	// Backslashes and quotes of paths are escaped
+	env = m.Env{SSLCert: `C:\certs\o'brien.pem`}
+	conn, err = m.PostgresSSLURL("host=localhost", env)
+	c.Assert(err, IsNil)
+	c.Check(conn, Equals, `host=localhost sslmode='verify-full' sslrootcert='C:\\certs\\o\'brien.pem'`)
+}
+
+func (s *MySuite) TestTLSConfig(c *C) {
+	env := m.Env{SSLClientCert: "/client.pem"}
+	_, err := env.TLSConfig()
+	c.Check(err, ErrorMatches, "-ssl-client-cert and -ssl-client-key must be set together")
+
+	env = m.Env{SSLInsecureSkipVerify: true}
+	config, err := env.TLSConfig()
+	c.Assert(err, IsNil)
+	c.Check(config.InsecureSkipVerify, Equals, true)
+}
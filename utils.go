@@ -1,54 +1,80 @@
 package moresql
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"runtime/pprof"
 	"strconv"
 	"strings"
 	"time"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/tidwall/gjson"
 
 	"github.com/rwynn/gtm"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
-func InitByFlag(e *Env) {
-	flag.StringVar(&e.configFile, "config-file", "", "Configuration file to use")
-	flag.BoolVar(&e.sync, "full-sync", false, "Run full sync for each db.collection in config")
-	flag.BoolVar(&e.allowDeletes, "allow-deletes", true, "Allow deletes to propagate from Mongo -> PG")
-
-	flag.BoolVar(&e.syncFile, "sync-file", false, "Get data from file and upsert into pg")
-	flag.StringVar(&e.syncFilePath, "sync-file-path", "", "File json location")
-	flag.StringVar(&e.syncFileCollection, "sync-file-collection", "", "Specific collection in config")
-	flag.StringVar(&e.syncFileDatabase, "sync-file-database", "", "Specific database in config")
-
-	flag.BoolVar(&e.tail, "tail", false, "Tail mongodb for each db.collection in config")
-	flag.StringVar(&e.tailType, "tail-type", "optlog", "Select tail type: optlog, change-stream")
-
-	flag.StringVar(&e.SSLCert, "ssl-cert", "", "SSL PEM cert for Mongodb")
-	flag.StringVar(&e.appName, "app-name", "moresql", "AppName used in Checkpoint table")
-	flag.BoolVar(&e.monitor, "enable-monitor", false, "Run expvarmon endpoint")
-	flag.BoolVar(&e.checkpoint, "checkpoint", false, "Store and restore from checkpoints in PG table: moresql_metadata")
-	flag.BoolVar(&e.createTableSQL, "create-table-sql", false, "Print out the necessary SQL for creating metadata table required for checkpointing")
-	flag.BoolVar(&e.validatePostgres, "validate", false, "Validate the postgres table structures and exit")
-	flag.StringVar(&e.errorReporting, "error-reporting", "", "Error reporting tool to use (currently only supporting Rollbar)")
-	flag.StringVar(&e.memprofile, "memprofile", "", "Profile memory usage. Supply filename for output of memory usage")
-
-	flag.StringVar(&e.csvPathFile, "csv-path-file", "", "Path to save file, default: /tmp/ahamove.csv")
-	flag.StringVar(&e.exports, "exports", "postgres", "Exporting to: postgres, csv or both postgres,csv")
+// InitByFlag registers the moresql flags of e on fs
+func InitByFlag(fs *flag.FlagSet, e *Env) {
+	fs.StringVar(&e.configFile, "config-file", "", "Configuration file to use")
+	fs.BoolVar(&e.sync, "full-sync", false, "Run full sync for each db.collection in config")
+	fs.StringVar(&e.fullSyncOnly, "full-sync-only", "", "Comma separated db.collection to full sync instead of the whole config, ie db.users,db.orders")
+	fs.IntVar(&e.fullSyncParallelism, "full-sync-parallelism", 4, "Number of _id range partitions full sync reads at once")
+	fs.IntVar(&e.fullSyncPartitions, "full-sync-partitions", 0, "Number of _id range partitions each collection is split into, defaults to -full-sync-parallelism")
+	fs.StringVar(&e.fullSyncFilter, "full-sync-filter", "", `Json object of db.collection to mongo query used by full sync, ie {"db.users": {"updated_at": {"$gte": {"$date": "2020-01-01T00:00:00Z"}}}}`)
+	fs.BoolVar(&e.allowDeletes, "allow-deletes", true, "Allow deletes to propagate from Mongo -> PG")
+
+	fs.BoolVar(&e.syncFile, "sync-file", false, "Get data from file and upsert into pg")
+	fs.StringVar(&e.syncFilePath, "sync-file-path", "", "File json location")
+	fs.StringVar(&e.syncFileCollection, "sync-file-collection", "", "Specific collection in config")
+	fs.StringVar(&e.syncFileDatabase, "sync-file-database", "", "Specific database in config")
+
+	fs.BoolVar(&e.tail, "tail", false, "Tail mongodb for each db.collection in config")
+	fs.BoolVar(&e.bootstrap, "bootstrap", false, "Run full sync then tail from the time the full sync started")
+	fs.StringVar(&e.tailType, "tail-type", "optlog", "Select tail type: optlog, change-stream")
+
+	fs.StringVar(&e.SSLCert, "ssl-cert", "", "SSL PEM CA bundle verifying the Mongodb and Postgres servers")
+	fs.StringVar(&e.SSLClientCert, "ssl-client-cert", "", "SSL PEM client certificate for Mongodb and Postgres, requires -ssl-client-key")
+	fs.StringVar(&e.SSLClientKey, "ssl-client-key", "", "SSL PEM client key for Mongodb and Postgres")
+	fs.StringVar(&e.appName, "app-name", "moresql", "AppName used in Checkpoint table")
+	fs.BoolVar(&e.monitor, "enable-monitor", false, "Run expvarmon endpoint and Prometheus /metrics")
+	fs.StringVar(&e.monitorAddr, "monitor-addr", ":1234", "Listen address of the expvarmon, /metrics, /healthz and /readyz endpoints")
+	fs.BoolVar(&e.enableAdmin, "enable-admin", false, "Serve the unauthenticated /admin API pausing fans and saving checkpoints, requires -enable-monitor")
+	fs.DurationVar(&e.readyMaxIdle, "ready-max-idle", time.Duration(0), "/readyz fails when no op was processed for this long, 0 disables the check")
+	fs.DurationVar(&e.readyMaxLag, "ready-max-lag", time.Duration(0), "/readyz fails when the last op lags behind mongo by more than this, 0 disables the check")
+	fs.BoolVar(&e.checkpoint, "checkpoint", false, "Store and restore from checkpoints in PG table: moresql_metadata")
+	fs.BoolVar(&e.createTableSQL, "create-table-sql", false, "Print out the necessary SQL for creating metadata table required for checkpointing")
+	fs.BoolVar(&e.validatePostgres, "validate", false, "Validate the postgres table structures and exit")
+	fs.BoolVar(&e.planSchema, "plan", false, "Print the SQL creating missing schemas, tables, columns, indexes and moresql_metadata and exit")
+	fs.BoolVar(&e.applySchema, "apply-schema", false, "Create missing schemas, tables, columns, indexes and moresql_metadata in one transaction and exit")
+	fs.StringVar(&e.errorReporting, "error-reporting", "", "Error reporting tool to use (currently only supporting Rollbar)")
+	fs.StringVar(&e.memprofile, "memprofile", "", "Profile memory usage. Supply filename for output of memory usage")
+
+	fs.StringVar(&e.csvPathFile, "csv-path-file", "", "Path to save file, default: /tmp/ahamove.csv")
+	fs.StringVar(&e.exports, "exports", "postgres", "Comma separated registered exporters: postgres, csv, mongo, ie postgres,csv")
 
 	defaultDuration := time.Duration(0 * time.Second)
-	flag.DurationVar(&e.replayDuration, "replay-duration", defaultDuration, "Last x to replay ie '1s', '5m', etc as parsed by Time.ParseDuration. Will be subtracted from time.Now()")
-	flag.Int64Var(&e.replaySecond, "replay-second", 0, "Replay a specific epoch second of the oplog and forward from there.")
-	flag.BoolVar(&e.SSLInsecureSkipVerify, "ssl-insecure-skip-verify", false, "Skip verification of Mongo SSL certificate ala sslAllowInvalidCertificates")
-	flag.IntVar(&e.postgresMaxOpenConns, "postgres-max-open-connections", 20, "Max opening connection in postgres")
-	flag.BoolVar(&e.justInsert, "just-insert", false, "Actions db collected: update, delete will be update, delete in db export, respective. If just-insert set true, others actions become insert")
-	flag.BoolVar(&e.skipError, "skip-error", false, "Action whether stop or not application when meeting error")
-	flag.Parse()
+	fs.DurationVar(&e.replayDuration, "replay-duration", defaultDuration, "Last x to replay ie '1s', '5m', etc as parsed by Time.ParseDuration. Will be subtracted from time.Now()")
+	fs.Int64Var(&e.replaySecond, "replay-second", 0, "Replay a specific epoch second of the oplog and forward from there.")
+	fs.BoolVar(&e.SSLInsecureSkipVerify, "ssl-insecure-skip-verify", false, "Skip verification of Mongo and Postgres SSL certificates ala sslAllowInvalidCertificates")
+	fs.IntVar(&e.postgresMaxOpenConns, "postgres-max-open-connections", 20, "Max opening connection in postgres")
+	fs.BoolVar(&e.justInsert, "just-insert", false, "Actions db collected: update, delete will be update, delete in db export, respective. If just-insert set true, others actions become insert")
+	fs.BoolVar(&e.skipError, "skip-error", false, "Action whether stop or not application when meeting error")
+	fs.StringVar(&e.deadLetters, "dead-letters", "", "Keep ops that fail to export instead of exiting: postgres for the moresql_dead_letters table, or the path of an NDJSON file")
+	fs.IntVar(&e.retryMaxAttempts, "retry-max-attempts", 5, "Max attempts of a write failing with a transient error such as a deadlock or a dropped connection, 1 disables retries")
+	fs.DurationVar(&e.retryBaseDelay, "retry-base-delay", time.Duration(100*time.Millisecond), "Delay before the first retry, doubled on each following attempt")
+	fs.DurationVar(&e.retryMaxDelay, "retry-max-delay", time.Duration(5*time.Second), "Max delay between retries")
+	fs.Float64Var(&e.retryJitter, "retry-jitter", 0.2, "Fraction of each retry delay that is randomized, 0 to 1")
+	fs.IntVar(&e.reconnectMaxAttempts, "reconnect-max-attempts", 10, "Max consecutive restarts of the mongo tail before exiting, 0 retries forever")
+	fs.StringVar(&e.onStreamInvalidate, "on-stream-invalidate", streamPolicyFail, "When mongo can no longer resume from the checkpoint: fail, resnapshot (full sync then tail) or resume-now")
+	fs.BoolVar(&e.replayDeadLetters, "replay-dead-letters", false, "Re-apply the ops kept by -dead-letters through their export and exit")
+	fs.IntVar(&e.batchSize, "batch-size", 0, "Group postgres writes per table into multi row statements of this size, 0 disables batching")
+	fs.DurationVar(&e.shutdownTimeout, "shutdown-timeout", time.Duration(30*time.Second), "Max time to drain buffered ops and save a final checkpoint on SIGTERM/SIGINT")
+	fs.DurationVar(&e.batchDuration, "batch-duration", time.Duration(500*time.Millisecond), "Max time a batched write waits before being flushed ie '500ms', '2s'")
 }
 
 func InitByEnv(e *Env) {
@@ -78,6 +104,26 @@ func InitByEnv(e *Env) {
 		e.sync = sync
 	}
 
+	if bootstrap, err := strconv.ParseBool(os.Getenv("BOOTSTRAP")); err == nil && bootstrap {
+		e.bootstrap = bootstrap
+	}
+
+	if len(os.Getenv("FULL_SYNC_ONLY")) > 0 {
+		e.fullSyncOnly = os.Getenv("FULL_SYNC_ONLY")
+	}
+
+	if len(os.Getenv("FULL_SYNC_FILTER")) > 0 {
+		e.fullSyncFilter = os.Getenv("FULL_SYNC_FILTER")
+	}
+
+	if parallelism, err := strconv.Atoi(os.Getenv("FULL_SYNC_PARALLELISM")); err == nil && parallelism > 0 {
+		e.fullSyncParallelism = parallelism
+	}
+
+	if partitions, err := strconv.Atoi(os.Getenv("FULL_SYNC_PARTITIONS")); err == nil && partitions > 0 {
+		e.fullSyncPartitions = partitions
+	}
+
 	if tail, err := strconv.ParseBool(os.Getenv("TAIL")); err == nil && tail {
 		e.tail = tail
 	}
@@ -90,6 +136,14 @@ func InitByEnv(e *Env) {
 		e.SSLCert = os.Getenv("SSL_CERT")
 	}
 
+	if len(os.Getenv("SSL_CLIENT_CERT")) > 0 {
+		e.SSLClientCert = os.Getenv("SSL_CLIENT_CERT")
+	}
+
+	if len(os.Getenv("SSL_CLIENT_KEY")) > 0 {
+		e.SSLClientKey = os.Getenv("SSL_CLIENT_KEY")
+	}
+
 	if len(os.Getenv("APP_NAME")) > 0 {
 		e.appName = os.Getenv("APP_NAME")
 	}
@@ -98,6 +152,22 @@ func InitByEnv(e *Env) {
 		e.monitor = monitor
 	}
 
+	if len(os.Getenv("MONITOR_ADDR")) > 0 {
+		e.monitorAddr = os.Getenv("MONITOR_ADDR")
+	}
+
+	if enableAdmin, err := strconv.ParseBool(os.Getenv("ENABLE_ADMIN")); err == nil && enableAdmin {
+		e.enableAdmin = enableAdmin
+	}
+
+	if readyMaxIdle, err := time.ParseDuration(os.Getenv("READY_MAX_IDLE")); err == nil {
+		e.readyMaxIdle = readyMaxIdle
+	}
+
+	if readyMaxLag, err := time.ParseDuration(os.Getenv("READY_MAX_LAG")); err == nil {
+		e.readyMaxLag = readyMaxLag
+	}
+
 	if checkpoint, err := strconv.ParseBool(os.Getenv("CHECK_POINT")); err == nil && checkpoint {
 		e.checkpoint = checkpoint
 	}
@@ -110,6 +180,14 @@ func InitByEnv(e *Env) {
 		e.validatePostgres = validatePostgres
 	}
 
+	if planSchema, err := strconv.ParseBool(os.Getenv("PLAN_SCHEMA")); err == nil && planSchema {
+		e.planSchema = planSchema
+	}
+
+	if applySchema, err := strconv.ParseBool(os.Getenv("APPLY_SCHEMA")); err == nil && applySchema {
+		e.applySchema = applySchema
+	}
+
 	if len(os.Getenv("ERROR_REPORTING")) > 0 {
 		e.errorReporting = os.Getenv("ERROR_REPORTING")
 
@@ -126,6 +204,14 @@ func InitByEnv(e *Env) {
 		e.exports = os.Getenv("EXPORTS")
 	}
 
+	if len(os.Getenv("DEAD_LETTERS")) > 0 {
+		e.deadLetters = os.Getenv("DEAD_LETTERS")
+	}
+
+	if replayDeadLetters, err := strconv.ParseBool(os.Getenv("REPLAY_DEAD_LETTERS")); err == nil && replayDeadLetters {
+		e.replayDeadLetters = replayDeadLetters
+	}
+
 	if replayDuration, err := strconv.Atoi(os.Getenv("REPLAY_DURATION")); err == nil && replayDuration > 0 {
 		e.replayDuration = time.Duration(replayDuration) * time.Second
 	}
@@ -149,12 +235,69 @@ func InitByEnv(e *Env) {
 	if skipError, err := strconv.ParseBool(os.Getenv("SKIP_ERROR")); err == nil && skipError {
 		e.skipError = skipError
 	}
+
+	if batchSize, err := strconv.Atoi(os.Getenv("BATCH_SIZE")); err == nil && batchSize > 0 {
+		e.batchSize = batchSize
+	}
+
+	if batchDuration, err := time.ParseDuration(os.Getenv("BATCH_DURATION")); err == nil && batchDuration > 0 {
+		e.batchDuration = batchDuration
+	}
+
+	if shutdownTimeout, err := time.ParseDuration(os.Getenv("SHUTDOWN_TIMEOUT")); err == nil && shutdownTimeout > 0 {
+		e.shutdownTimeout = shutdownTimeout
+	}
+
+	if retryMaxAttempts, err := strconv.Atoi(os.Getenv("RETRY_MAX_ATTEMPTS")); err == nil && retryMaxAttempts > 0 {
+		e.retryMaxAttempts = retryMaxAttempts
+	}
+
+	if retryBaseDelay, err := time.ParseDuration(os.Getenv("RETRY_BASE_DELAY")); err == nil && retryBaseDelay > 0 {
+		e.retryBaseDelay = retryBaseDelay
+	}
+
+	if retryMaxDelay, err := time.ParseDuration(os.Getenv("RETRY_MAX_DELAY")); err == nil && retryMaxDelay > 0 {
+		e.retryMaxDelay = retryMaxDelay
+	}
+
+	if retryJitter, err := strconv.ParseFloat(os.Getenv("RETRY_JITTER"), 64); err == nil && retryJitter >= 0 && retryJitter <= 1 {
+		e.retryJitter = retryJitter
+	}
+
+	if reconnectMaxAttempts, err := strconv.Atoi(os.Getenv("RECONNECT_MAX_ATTEMPTS")); err == nil && reconnectMaxAttempts >= 0 {
+		e.reconnectMaxAttempts = reconnectMaxAttempts
+	}
+
+	if len(os.Getenv("ON_STREAM_INVALIDATE")) > 0 {
+		e.onStreamInvalidate = os.Getenv("ON_STREAM_INVALIDATE")
+	}
 }
 
+// FetchEnvsAndFlags reads the command line flags and
+// the environment variables of the moresql command
 func FetchEnvsAndFlags() (e Env) {
-	InitByFlag(&e)
+	InitByFlag(flag.CommandLine, &e)
+	flag.Parse()
+	InitByEnv(&e)
+	setEnvDefaults(&e)
+	return
+}
+
+// ParseEnv reads the moresql flags of args, as they would be given to the
+// moresql command, and the environment variables
+func ParseEnv(args []string) (e Env, err error) {
+	fs := flag.NewFlagSet("moresql", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	InitByFlag(fs, &e)
+	if err = fs.Parse(args); err != nil {
+		return
+	}
 	InitByEnv(&e)
+	setEnvDefaults(&e)
+	return
+}
 
+func setEnvDefaults(e *Env) {
 	if e.appEnvironment == "" {
 		e.appEnvironment = "production"
 	}
@@ -163,25 +306,28 @@ func FetchEnvsAndFlags() (e Env) {
 	} else {
 		e.replayOplog = false
 	}
+}
 
-	if e.memprofile != "" {
-		f, err := os.Create(e.memprofile)
-		if err != nil {
-			log.Fatal(err)
-		}
-		wg.Add(1)
-		go func() {
-			defer f.Close()
-			tick := time.Tick(time.Duration(20) * time.Second)
-			for {
-				select {
-				case <-tick:
-					pprof.WriteHeapProfile(f)
-				}
+// WriteMemProfile writes a heap profile to path every 20 seconds until ctx is done
+func WriteMemProfile(ctx context.Context, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	go func() {
+		defer f.Close()
+		tick := time.NewTicker(time.Duration(20) * time.Second)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick.C:
+				pprof.WriteHeapProfile(f)
 			}
-		}()
-	}
-	return
+		}
+	}()
+	return nil
 }
 
 func IsInsertUpdateDelete(op *gtm.Op) bool {
@@ -380,6 +526,21 @@ func createFanKey(db string, collection string, export string) string {
 	return db + "." + collection + "." + export
 }
 
+// splitFanKey is the db, collection and export of a key made by
+// createFanKey. Dbs have no dots and exports are registered without,
+// so only the collection can hold dots.
+func splitFanKey(key string) (db string, collection string, export string) {
+	parts := strings.SplitN(key, ".", 2)
+	if len(parts) != 2 {
+		return key, "", ""
+	}
+	i := strings.LastIndex(parts[1], ".")
+	if i < 0 {
+		return parts[0], parts[1], ""
+	}
+	return parts[0], parts[1][:i], parts[1][i+1:]
+}
+
 // EnsureOpHasAllFields: Ensure that required keys are present will null value
 func EnsureOpHasAllFields(op *gtm.Op, keysToEnsure []string) *gtm.Op {
 	// Guard against assignment into nil map
@@ -410,62 +571,69 @@ func HasTypeExport(exportsTo []string, exportType string) bool {
 	return false
 }
 
+// EnsureRightExport checks that every export has a registered Exporter
 func EnsureRightExport(exports []string) bool {
-	counter := 0
 	for _, export := range exports {
-		if export == mongoExport || export == csvExport || export == postgresExport {
-			counter++
+		if _, ok := lookupExporter(export); !ok {
+			return false
 		}
 	}
-	return counter == len(exports)
+	return true
 }
 
-func ExitUnlessValidEnv(e Env) {
+// ValidateEnv checks the flags and environment variables of e
+// are enough for what they ask moresql to do
+func ValidateEnv(e Env) error {
 	if len(e.configFile) == 0 {
-		log.Warnf(`Missing config file path`)
-		os.Exit(1)
+		return fmt.Errorf("missing config file path, set -config-file or CONFIG_FILE")
 	}
 
 	exportsTo := strings.Split(e.exports, ",")
 	if !EnsureRightExport(exportsTo) {
-		log.WithFields(log.Fields{"exports": e.exports}).Warnf(`Export set wrong, just: postgres, csv, mongo`)
-		os.Exit(1)
+		return fmt.Errorf("-exports %s must only list registered exporters: %s", e.exports, strings.Join(Exporters(), ", "))
 	}
 
-	if e.validatePostgres {
-		return
+	if e.validatePostgres || e.planSchema || e.applySchema {
+		if e.urls.postgres == "" {
+			return fmt.Errorf("missing required variable, POSTGRES_URL must be set")
+		}
+		return nil
 	}
 
 	if e.createTableSQL {
-		c := Commands{}
-		c.CreateTableSQL()
+		return nil
+	}
+
+	if !isStreamPolicy(e.onStreamInvalidate) {
+		return fmt.Errorf("-on-stream-invalidate must be one of fail, resnapshot or resume-now")
+	}
+
+	if e.replayDeadLetters && e.deadLetters == "" {
+		return fmt.Errorf("missing required variable, -replay-dead-letters requires DEAD_LETTERS")
+	}
+
+	if e.bootstrap && !e.checkpoint {
+		return fmt.Errorf("-bootstrap requires -checkpoint, the tail starts from the checkpoint it saves")
 	}
 
-	if e.urls.mongo == "" && !e.syncFile {
-		log.Warnf(`Missing required variable. MONGO_URL must be set. 
-		            See the following usage instructions for setting those variables.`)
-		os.Exit(1)
+	if e.urls.mongo == "" && !e.syncFile && !e.replayDeadLetters {
+		return fmt.Errorf("missing required variable, MONGO_URL must be set")
 	}
 
 	if e.urls.postgres == "" && HasTypeExport(exportsTo, postgresExport) {
-		log.Warnf(`Missing required variable. POSTGRES_URL must be set.
-					See the following usage instruction for setting those variables.`)
-		os.Exit(1)
+		return fmt.Errorf("missing required variable, POSTGRES_URL must be set")
 	}
 
 	if e.urls.mongoExport == "" && HasTypeExport(exportsTo, mongoExport) {
-		log.Warnf(`Missing required variable. MONGO_EXPORT_URL must be set.
-					See the following usage instruction for setting those variables.`)
-		os.Exit(1)
+		return fmt.Errorf("missing required variable, MONGO_EXPORT_URL must be set")
 	}
 
-	if !(e.sync || e.tail || e.syncFile) {
-		log.WithFields(log.Fields{"sync": e.sync, "tail": e.tail, "sync_file": e.syncFile}).Warnf(`Missing sync or tail or sync file`)
-		os.Exit(1)
+	if !(e.sync || e.tail || e.syncFile || e.bootstrap || e.replayDeadLetters) {
+		return fmt.Errorf("missing -full-sync, -tail, -sync-file, -bootstrap or -replay-dead-letters")
 	}
 
 	if !EnsureRightTailType(e.tailType) {
-		log.Warnf(`Tail type set wrong, just: optlog or change-stream`)
-		os.Exit(1)
+		return fmt.Errorf("-tail-type must be optlog or change-stream")
 	}
+	return nil
 }
@@ -3,18 +3,18 @@ package moresql_test
 import (
 	"github.com/rwynn/gtm"
 	m "github.com/zph/moresql"
-	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	. "gopkg.in/check.v1"
 )
 
 func (s *MySuite) TestSanitizeData(c *C) {
-	bsonId := bson.ObjectId("123")
+	bsonId := primitive.NewObjectID()
 	withBson := map[string]interface{}{"_id": bsonId}
-	withBsonResult := map[string]interface{}{"name": interface{}(nil), "age": interface{}(nil), "location_id": interface{}(nil), "_id": "313233"}
-	withSymbol := map[string]interface{}{"name": bson.Symbol("Alice")}
+	withBsonResult := map[string]interface{}{"name": interface{}(nil), "age": interface{}(nil), "location_id": interface{}(nil), "_id": bsonId.Hex()}
+	withSymbol := map[string]interface{}{"name": primitive.Symbol("Alice")}
 	withSymbolResult := map[string]interface{}{"age": interface{}(nil), "location_id": interface{}(nil), "_id": interface{}(nil), "name": "Alice"}
 	withNonPrimaryKey := map[string]interface{}{"name": "Alice", "location_id": bsonId}
-	withNonPrimaryKeyResult := map[string]interface{}{"_id": interface{}(nil), "name": "Alice", "age": interface{}(nil), "location_id": "313233"}
+	withNonPrimaryKeyResult := map[string]interface{}{"_id": interface{}(nil), "name": "Alice", "age": interface{}(nil), "location_id": bsonId.Hex()}
 	var table = []struct {
 		op     *gtm.Op
 		result map[string]interface{}
@@ -24,7 +24,7 @@ func (s *MySuite) TestSanitizeData(c *C) {
 		{&gtm.Op{Operation: "i", Data: withNonPrimaryKey}, withNonPrimaryKeyResult},
 	}
 	for _, t := range table {
-		actual, _ := m.SanitizeData(BuildFields("_id", "name", "age", "location_id"), t.op, true, false)
+		actual, _ := m.SanitizeData(m.Collection{Fields: BuildFields("_id", "name", "age", "location_id")}, t.op, false, false)
 		c.Check(actual, DeepEquals, t.result)
 	}
 
@@ -58,7 +58,7 @@ func (s *MySuite) TestSanitizeData(c *C) {
 		{&gtm.Op{Operation: "i", Data: stub}, address, result},
 	}
 	for _, t := range nested {
-		actual, _ := m.SanitizeData(t.fields, t.op, true, false)
+		actual, _ := m.SanitizeData(m.Collection{Fields: t.fields}, t.op, false, false)
 		c.Check(actual, DeepEquals, t.result)
 	}
 }